@@ -0,0 +1,98 @@
+//go:build bench
+
+package chat
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// The benchmarks in this file connect more clients, or take longer, than
+// the normal test run should, and only build with the bench tag:
+//
+//	go test -tags bench -run '^$' -bench . -benchmem ./chat
+//
+// One operation of BenchmarkFanOut is a message posted by one client and
+// read by all the others. It also reports the slowest operation and the
+// heap each connected client takes, which includes the test's own end of
+// the connection. Compare runs on the same machine with benchstat.
+
+func BenchmarkFanOut(b *testing.B) {
+	for _, clients := range []int{100, 1000} {
+		b.Run(fmt.Sprintf("clients=%d", clients), func(b *testing.B) {
+			chat := newTestChat(b, Config{MaxClients: clients})
+
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			h := startFanOut(b, chat, clients)
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			heap := int64(after.HeapAlloc) - int64(before.HeapAlloc)
+
+			var longest time.Duration
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				h.post(0)
+				longest = max(longest, h.wait(b, clients-1))
+			}
+			b.ReportMetric(float64(longest.Microseconds()), "max-µs")
+			b.ReportMetric(float64(heap)/float64(clients), "heap-B/client")
+		})
+	}
+}
+
+// BenchmarkWriteBatching sends one client bursts of small messages that
+// arrive a little apart, as in a busy room, and reports the writes, which
+// are syscalls on a real connection, each message took.
+func BenchmarkWriteBatching(b *testing.B) {
+	const burst = 16
+	for _, interval := range []time.Duration{0, time.Millisecond} {
+		b.Run(fmt.Sprintf("interval=%s", interval), func(b *testing.B) {
+			config := DefaultConfig()
+			config.FlushInterval = interval
+			chat, err := New(config)
+			if err != nil {
+				b.Fatal(err)
+			}
+			server, remote := net.Pipe()
+			defer remote.Close()
+			conn := &writeCounter{Conn: server}
+			client := chat.newClient(conn)
+			go client.writeLoop()
+			defer client.Close(disconnectQuit)
+
+			lines := make(chan struct{}, burst)
+			go func() {
+				r := bufio.NewReader(remote)
+				for {
+					if _, err := r.ReadString('\n'); err != nil {
+						return
+					}
+					lines <- struct{}{}
+				}
+			}()
+
+			b.ResetTimer()
+			for range b.N {
+				for i := range burst {
+					client.Notify(fmt.Sprintf("alice> message %d\n", i), serverSender)
+					// Yield rather than sleep, as sleeps this short
+					// overshoot
+					for start := time.Now(); time.Since(start) < 50*time.Microsecond; {
+						runtime.Gosched()
+					}
+				}
+				for range burst {
+					<-lines
+				}
+			}
+			b.ReportMetric(float64(conn.writes.Load())/float64(b.N*burst), "writes/msg")
+		})
+	}
+}
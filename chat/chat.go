@@ -0,0 +1,4063 @@
+/* chat.go -- The smallchat server.
+ *
+ * This package implements a TCP server that accepts incoming connections
+ * and allows clients to send messages to each other in a chat-room style interface.
+ * Clients can set their nicknames with the /nick command and send messages to all
+ * other connected clients.
+ *
+ * Features:
+ * - Concurrent handling of multiple chat clients.
+ * - Nickname assignment for clients.
+ * - Broadcasting messages to all clients.
+ * - Go-routine for each client handling.
+ * - Graceful shutdown on receiving interrupt or terminate signals.
+ * - Operator login with connection slots reserved for operators.
+ *
+ * Copyright (c) 2023, cheney
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *   * Redistributions of source code must retain the above copyright notice,
+ *     this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in the
+ *     documentation and/or other materials provided with the distribution.
+ *   * Neither the name of the project nor the names of its contributors may be used
+ *     to endorse or promote products derived from this software without
+ *     specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package chat implements the smallchat server. The smallchat command runs
+// it from the command line; other programs can embed it with New and
+// Serve, and talk to the connected clients with BroadcastTo and
+// BroadcastWhere.
+package chat
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Constants
+const (
+	ServerPort               = "7712"                                                                         // Port on which the chat server listens
+	MaxClients               = 1000                                                                           // Maximum number of allowed clients
+	protocolVersion          = "v1"                                                                           // Protocol version advertised in the capability line
+	welcomeMessage           = "Welcome to the chat server! Type '/nick NAME' to set your nickname.\n"        // Welcome message for clients
+	unknownCmdMsg            = "Unsupported command\n"                                                        // Message for unsupported commands
+	reservedMsg              = "Server is full, only operators may connect. Send '/oper PASSWORD'.\n"         // Prompt for reserved slots
+	nickRequiredMsg          = "This server requires a nickname, set one with '/nick NAME' before posting.\n" // Notice for anonymous clients under the nick-required policy
+	bannedMsg                = "You are banned from this server\n"                                            // Notice for connections from banned addresses
+	fullMsg                  = "Server is full, try again later\n"                                            // Notice for connections beyond MaxClients
+	busyMsg                  = "Server is busy, try again later\n"                                            // Notice for connections without a free handler slot
+	shutdownMsg              = "Server is shutting down, goodbye!\n"                                          // Notice sent to clients on shutdown
+	tooSlowMsg               = "disconnected: too slow\n"                                                     // Last line sent to a client dropped for falling behind
+	mentionBell              = "\a"                                                                           // Prefix that rings the terminal bell of a client mentioned or sent a private message
+	minAcceptBackoff         = 5 * time.Millisecond                                                           // Initial retry delay after a failed Accept
+	maxAcceptBackoff         = time.Second                                                                    // Upper bound for the Accept retry delay
+	fdExhaustedPause         = 5 * time.Second                                                                // Pause after running out of file descriptors
+	unfurlTimeout            = 2 * time.Second                                                                // Time allowed to fetch a link title
+	unfurlMaxBody            = 256 << 10                                                                      // Bytes of a page read when looking for its title
+	unfurlMaxRedirects       = 3                                                                              // Redirects followed when fetching a link title
+	unfurlCacheTTL           = 10 * time.Minute                                                               // How long fetched link titles are cached
+	unfurlMaxFetches         = 4                                                                              // Link titles fetched at once; further links are skipped
+	unfurlMaxTitle           = 200                                                                            // Runes of a link title posted to the chat
+	defaultQuitAliases       = "quit,exit,leave,q"                                                            // Commands that disconnect the client unless configured otherwise
+	maxUsageCommands         = 64                                                                             // Distinct command names tracked by the usage counters
+	handlerWait              = 200 * time.Millisecond                                                         // Time a new connection waits for a free handler slot
+	reconnectBase            = 5 * time.Second                                                                // Reconnect hint given to clients on an idle server
+	reconnectMaxExtra        = 55 * time.Second                                                               // Extra reconnect wait hinted on a full server
+	quietSlowInterval        = 30 * time.Second                                                               // Time between messages under the slow quiet hours policy
+	pathologicalLineMin      = 16                                                                             // Shortest line whose read pattern is judged
+	pathologicalBytesPerRead = 2.0                                                                            // Average bytes per read below which a client's reads are reported
+	recordAnnounceInterval   = time.Hour                                                                      // Minimum time between announcements of a new peak of clients
+	maxTempSeconds           = 24 * 60 * 60                                                                   // Longest lifetime of a /temp message, in seconds
+	maxLineLength            = 64 << 10                                                                       // Longest line read from a client; longer lines are discarded
+	outboundQueueSize        = 256                                                                            // Messages queued for a client before it is disconnected as too slow
+	queueHighWater           = 75                                                                             // Percent of MaxQueuedBytes over which presence notices are shed
+	queueLowWater            = 50                                                                             // Percent of MaxQueuedBytes under which presence notices resume
+	maxPriorityStreak        = 8                                                                              // Priority messages written in a row before a normal one is let through
+	writeBatchSize           = 16 << 10                                                                       // Bytes gathered into one write to a client; a full batch skips the flush interval
+	closeFlushTimeout        = 2 * time.Second                                                                // Time to write a closing client's queued messages
+	maxRecipients            = 5                                                                              // Clients one private message may be addressed to
+	dmHistorySize            = 50                                                                             // Private messages kept per conversation for /msgs
+	maxWarnedHosts           = 1024                                                                           // Addresses whose warnings are counted for /warnings
+	maxHeldMessages          = 10                                                                             // Messages queued per client during the join cooldown; more are rejected
+	maxRandomRun             = 2.75                                                                           // Average run of letters of one case, or digits, below which a string looks random
+	componentStopTimeout     = 15 * time.Second                                                               // Time a background component has to stop at shutdown
+	shutdownTimeout          = 5 * time.Second                                                                // Time allowed for the shutdown notice to be written
+)
+
+// Handshake states of a connection watched by watchHandshake
+const (
+	handshakeWaiting = iota // No line has been read yet
+	handshakeDone           // A line was read before the timeout
+	handshakeExpired        // The timeout passed first
+)
+
+// Identity policies, controlling what clients must do before posting
+const (
+	policyAnonymousOK  = "anonymous-ok"  // Anyone may post, with or without a nickname
+	policyNickRequired = "nick-required" // Clients must set a nickname before posting
+)
+
+// Cooldown policies, controlling what happens to messages a client sends
+// right after connecting
+const (
+	cooldownReject = "reject" // The client is told to wait and the message is dropped
+	cooldownQueue  = "queue"  // The message is posted when the cooldown ends
+)
+
+// Leave notice scopes, controlling who is told when a client disconnects.
+// There are no rooms, so the whole server is the narrowest audience.
+const (
+	leaveScopeServer = "server" // Every connected client is told
+	leaveScopeNone   = "none"   // Nobody is told
+)
+
+// Config holds the runtime settings of the chat server.
+type Config struct {
+	Port             string        // Port on which the chat server listens
+	MaxClients       int           // Maximum number of allowed clients
+	ReservedSlots    int           // Last slots below MaxClients kept for operators
+	OperPassword     string        // Password for /oper; empty disables operator login
+	MaxNickChanges   int           // Nickname changes allowed per session; 0 means unlimited
+	HandshakeTimeout time.Duration // Time a new connection has to send its first line; 0 disables it
+	Unfurl           bool          // Whether to post the titles of links at startup
+	IdentityPolicy   string        // What clients must do before posting: "anonymous-ok" or "nick-required"
+	UsageStats       bool          // Whether to count command and nickname usage
+	MaxFanOut        int           // Recipients of one message above which a warning is logged; 0 disables it
+	WelcomeOccupants bool          // Whether the welcome lists the clients already connected
+	MsgRate          float64       // Lines a client may send per second; 0 disables the limit
+	ByteRate         int           // Bytes a client may send per second; 0 disables the limit
+	MaxLength        int           // Longest message a client may post, in bytes; 0 disables the limit
+	QuietHours       string        // Daily window such as "22:00-07:00"; empty disables quiet hours
+	QuietZone        string        // Time zone of the quiet hours window
+	QuietPolicy      string        // Policy applied during quiet hours: "slow" or "readonly"
+	QuitAliases      []string      // Commands that disconnect the client, e.g. "/quit"
+	MaxHandlers      int           // Client handler goroutines allowed at once; 0 means MaxClients
+	MaxSubscriptions int           // Keywords a client may subscribe to; 0 means unlimited
+	JoinCooldown     time.Duration // Time after connecting before a client's messages are posted; 0 disables it
+	CooldownPolicy   string        // What happens to messages during the cooldown: "reject" or "queue"
+	MaskSecrets      string        // Comma-separated secret patterns masked in messages; empty disables masking
+	AnnounceRecords  bool          // Whether a new peak of connected clients is announced to everyone
+	LockStats        bool          // Whether to measure contention on the chat lock for /stats
+	MaxMentions      int           // Distinct users a message may mention and still ring their bells; 0 means unlimited
+	RejectMentions   int           // Distinct users a message may mention at all; 0 means unlimited
+	WarnMute         int           // Warnings within WarnWindow that mute a client; 0 disables muting
+	WarnKick         int           // Warnings within WarnWindow that kick a client; 0 disables kicking
+	WarnWindow       time.Duration // How long a warning counts toward escalation
+	MuteDuration     time.Duration // How long an escalation mute lasts
+	FlushInterval    time.Duration // Time a client's writer waits to gather messages into one write; 0 writes at once
+	PeakFile         string        // File the peak of connected clients is kept in across restarts; empty keeps it per process
+	LeaveScope       string        // Who is told when a client disconnects: "server" or "none"
+	MaxQueuedBytes   int           // Bytes queued for all clients together before the slowest are disconnected, and presence notices shed short of it; 0 disables both
+}
+
+// DefaultConfig returns the settings the smallchat command starts from
+// before applying its flags.
+func DefaultConfig() Config {
+	return Config{
+		Port:             ServerPort,
+		MaxClients:       MaxClients,
+		IdentityPolicy:   policyAnonymousOK,
+		UsageStats:       true,
+		QuietZone:        "Local",
+		QuietPolicy:      quietSlow,
+		QuitAliases:      parseCommandList(defaultQuitAliases),
+		MaxSubscriptions: 20,
+		JoinCooldown:     5 * time.Second,
+		CooldownPolicy:   cooldownReject,
+		LeaveScope:       leaveScopeServer,
+		MaskSecrets:      "aws,slack,pem,hex,base64",
+		AnnounceRecords:  true,
+		MaxMentions:      5,
+		RejectMentions:   15,
+		WarnMute:         3,
+		WarnKick:         5,
+		WarnWindow:       24 * time.Hour,
+		MuteDuration:     10 * time.Minute,
+	}
+}
+
+// Clock tells the time and creates timers. All time-dependent behavior of
+// the chat goes through it, so a fake clock can stand in for the real one.
+// Socket deadlines are the exception: the kernel enforces those against
+// the wall clock.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a single-shot timer created by a Clock.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// realClock is the Clock backed by the time package.
+type realClock struct{}
+
+// Now returns the current time.
+func (realClock) Now() time.Time { return time.Now() }
+
+// NewTimer creates a timer that fires after d.
+func (realClock) NewTimer(d time.Duration) Timer { return realTimer{time.NewTimer(d)} }
+
+// realTimer adapts *time.Timer to the Timer interface.
+type realTimer struct{ *time.Timer }
+
+// C returns the channel the timer fires on.
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
+
+// sleep blocks for d as measured by the chat's clock, or until ctx is
+// cancelled, and reports whether the whole time passed.
+func (chat *ChatSystem) sleep(ctx context.Context, d time.Duration) bool {
+	timer := chat.clock.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// ClientID uniquely identifies a chat client.
+type ClientID int
+
+// String returns the display form of the ID, as used for clients
+// without a nickname.
+func (id ClientID) String() string {
+	return fmt.Sprintf("user:%d", int(id))
+}
+
+// parseClientID parses a client ID written either as "user:N" or "N",
+// with N in plain decimal digits.
+func parseClientID(s string) (ClientID, error) {
+	digits := strings.TrimPrefix(s, "user:")
+	if strings.ContainsFunc(digits, func(r rune) bool { return r < '0' || r > '9' }) {
+		return 0, fmt.Errorf("invalid client ID %q", s)
+	}
+	n, err := strconv.Atoi(digits)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid client ID %q", s)
+	}
+	return ClientID(n), nil
+}
+
+// DisconnectReason says why a client was disconnected.
+type DisconnectReason string
+
+// Reasons for disconnecting a client
+const (
+	disconnectQuit             DisconnectReason = "quit"              // The client closed the connection
+	disconnectReadError        DisconnectReason = "read_error"        // Reading from the client failed
+	disconnectWriteError       DisconnectReason = "write_error"       // Writing to the client failed
+	disconnectTooSlow          DisconnectReason = "too_slow"          // The client's outbound queue filled up
+	disconnectHandshakeTimeout DisconnectReason = "handshake_timeout" // The client sent nothing after connecting
+	disconnectServerFull       DisconnectReason = "server_full"       // No free slot for a non-operator
+	disconnectKicked           DisconnectReason = "kicked"            // Removed by an operator
+	disconnectBanned           DisconnectReason = "banned"            // Banned by an operator
+	disconnectShutdown         DisconnectReason = "shutdown"          // The server is shutting down
+)
+
+// ChatObserver interface defines methods that chat clients should implement.
+type ChatObserver interface {
+	Notify(message string, senderID ClientID)
+}
+
+// serverSender is the sender ID of notices from the server itself, which
+// reach every client.
+const serverSender ClientID = 0
+
+// identifiedObserver is implemented by observers that are chat
+// participants, so broadcasts can leave out the sender.
+type identifiedObserver interface {
+	ID() ClientID
+}
+
+// NickChangeObserver is implemented by observers that need to know when a
+// client changes its nickname. State about clients is keyed by ClientID,
+// with nicknames resolved only for display and at command time, so most
+// observers don't need this; it is for those showing nicknames they have
+// already seen.
+type NickChangeObserver interface {
+	NickChanged(id ClientID, oldNick, newNick string)
+}
+
+// ObserverInfo describes a connected client to targeted broadcasts.
+type ObserverInfo struct {
+	ID   ClientID // Client ID
+	Nick string   // Nickname, empty if not set
+	Oper bool     // Whether the client is an operator
+}
+
+// ChatSystem represents the chat server.
+type ChatSystem struct {
+	observers  []ChatObserver       // List of chat observers (clients)
+	index      map[ChatObserver]int // Position of each observer in the list
+	clients    map[*Client]bool     // Clients from accept until they are closed, guarded by mu
+	closing    bool                 // Set when shutdown starts, guarded by mu
+	replay     []ChatObserver       // Broadcast-only observers, not counted as clients
+	mu         timedMutex           // Mutex to protect concurrent access to the observers list
+	serversock net.Listener         // Listener for incoming client connections
+	config     Config               // Runtime settings
+
+	lastClientID       atomic.Int64             // Last client ID handed out
+	fdExhaustions      atomic.Int64             // Accept pauses caused by file descriptor exhaustion
+	droppedMessages    atomic.Int64             // Lines rejected by rate, length or identity checks
+	filteredDeliveries atomic.Int64             // Broadcast deliveries skipped by subscription filters
+	pathologicalReads  atomic.Int64             // Clients reported for sending their lines a byte or two per read
+	queuedBytes        atomic.Int64             // Bytes queued for all clients' writers
+	shedding           atomic.Bool              // Set while shedLoad disconnects clients
+	shedClients        atomic.Int64             // Clients disconnected to keep queuedBytes within MaxQueuedBytes
+	overloaded         atomic.Bool              // Set while queuedBytes is over the high-water mark, until it is under the low-water mark
+	overloads          atomic.Int64             // Times queuedBytes went over the high-water mark
+	shedNotices        atomic.Int64             // Presence notices dropped while overloaded
+	maskedSecrets      atomic.Int64             // Secrets masked in messages before delivery
+	secretPatterns     []secretPattern          // Secrets masked in messages; empty disables masking
+	unfurlEnabled      atomic.Bool              // Whether link titles are posted, toggled with /unfurl
+	unfurler           *unfurler                // Link title fetcher
+	bans               map[string]bool          // Banned client addresses, guarded by mu
+	hostWarnings       map[string][]time.Time   // When clients from each address were warned, for /warnings only, guarded by mu
+	dms                map[dmPair][]dmEntry     // Recent private messages per conversation, guarded by mu
+	disconnects        map[DisconnectReason]int // Clients disconnected for each reason, guarded by mu
+	peakClients        int                      // Most clients connected at once, guarded by mu
+	peakAt             time.Time                // When peakClients was reached, guarded by mu
+	recordAnnounced    time.Time                // When a record was last announced, guarded by mu
+	peakFileMu         sync.Mutex               // Mutex to serialize the writes of PeakFile
+	usage              *usageStats              // Feature usage counters; nil when disabled
+	handlers           chan struct{}            // Semaphore bounding running client handlers
+	quietHours         *quietHours              // Daily restricted posting window; nil when not configured
+	clock              Clock                    // Source of time for everything but socket deadlines
+	lifecycle          lifecycle                // Background components started and stopped by Run
+	tasks              *tasks                   // Short-lived background work, stopped with the lifecycle
+}
+
+// tryAddObserver adds a chat observer (client) to the list unless the
+// server already has MaxClients clients, or MaxClients-ReservedSlots for
+// anyone but an operator, or is shutting down, and reports whether it
+// did. The check and the add happen under one lock, so concurrent joins
+// cannot overshoot either limit, nor slip in after shutdown has detached
+// the clients.
+func (chat *ChatSystem) tryAddObserver(observer ChatObserver) bool {
+	limit := chat.config.MaxClients
+	if client, ok := observer.(*Client); !ok || !client.oper.Load() {
+		limit -= chat.config.ReservedSlots
+	}
+
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+	if chat.closing || len(chat.observers) >= limit {
+		return false
+	}
+	if chat.index == nil {
+		chat.index = make(map[ChatObserver]int)
+	}
+	chat.index[observer] = len(chat.observers)
+	chat.observers = append(chat.observers, observer)
+	return true
+}
+
+// removeObserver removes a chat observer (client) from the list and
+// reports whether it was there.
+func (chat *ChatSystem) removeObserver(observer ChatObserver) bool {
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+	return chat.removeObserverLocked(observer)
+}
+
+// removeObserverLocked removes an observer in constant time by moving the
+// last one into its place, so the list is not kept in join order. It must
+// be called with chat.mu held.
+func (chat *ChatSystem) removeObserverLocked(observer ChatObserver) bool {
+	i, ok := chat.index[observer]
+	if !ok {
+		return false
+	}
+	last := len(chat.observers) - 1
+	chat.observers[i] = chat.observers[last]
+	chat.index[chat.observers[i]] = i
+	chat.observers[last] = nil
+	chat.observers = chat.observers[:last]
+	delete(chat.index, observer)
+	return true
+}
+
+// AddReplayObserver registers an observer that receives every broadcast
+// but never sends. Replay observers are meant for internal components such
+// as a dashboard streaming the chat activity: they do not take a client
+// slot and are not listed as occupants.
+func (chat *ChatSystem) AddReplayObserver(observer ChatObserver) {
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+	chat.replay = append(chat.replay, observer)
+}
+
+// RemoveReplayObserver unregisters a replay observer.
+func (chat *ChatSystem) RemoveReplayObserver(observer ChatObserver) {
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+	for i, obs := range chat.replay {
+		if obs == observer {
+			chat.replay = append(chat.replay[:i], chat.replay[i+1:]...)
+			break
+		}
+	}
+}
+
+// clientCount returns the number of connected chat clients.
+func (chat *ChatSystem) clientCount() int {
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+	return len(chat.observers)
+}
+
+// nickChanged tells the observers and replay observers implementing
+// NickChangeObserver that a client changed its nickname. oldNick is empty
+// for a client's first nickname.
+func (chat *ChatSystem) nickChanged(id ClientID, oldNick, newNick string) {
+	chat.mu.Lock()
+	var interested []NickChangeObserver
+	for _, observer := range slices.Concat(chat.observers, chat.replay) {
+		if o, ok := observer.(NickChangeObserver); ok {
+			interested = append(interested, o)
+		}
+	}
+	chat.mu.Unlock()
+
+	for _, o := range interested {
+		o.NickChanged(id, oldNick, newNick)
+	}
+}
+
+// checkRecord updates the peak number of connected clients and, when a
+// new record is set, logs it and announces it if enabled. Announcements
+// are limited to one per recordAnnounceInterval so reconnect churn can't
+// flood the chat with them.
+func (chat *ChatSystem) checkRecord() {
+	now := chat.clock.Now()
+
+	chat.mu.Lock()
+	count := len(chat.observers)
+	if count <= chat.peakClients {
+		chat.mu.Unlock()
+		return
+	}
+	previous := chat.peakClients
+	chat.peakClients = count
+	chat.peakAt = now
+	announce := chat.config.AnnounceRecords && previous > 0 && now.Sub(chat.recordAnnounced) >= recordAnnounceInterval
+	if announce {
+		chat.recordAnnounced = now
+	}
+	chat.mu.Unlock()
+
+	log.Printf("New record: %d clients connected", count)
+	chat.savePeak()
+	if announce {
+		chat.broadcast(fmt.Sprintf("* New record: %d users online!\n", count), serverSender)
+	}
+}
+
+// loadPeak reads the peak of connected clients kept in PeakFile by an
+// earlier run, so records are counted across restarts. A missing file
+// means there is no peak yet.
+func (chat *ChatSystem) loadPeak() error {
+	data, err := os.ReadFile(chat.config.PeakFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) != 3 {
+		return fmt.Errorf("%s: want a count and two times, got %q", chat.config.PeakFile, data)
+	}
+	count, err := strconv.Atoi(fields[0])
+	if err != nil || count < 0 {
+		return fmt.Errorf("%s: bad count %q", chat.config.PeakFile, fields[0])
+	}
+	var times [2]time.Time
+	for i, field := range fields[1:] {
+		if times[i], err = time.Parse(time.RFC3339, field); err != nil {
+			return fmt.Errorf("%s: %w", chat.config.PeakFile, err)
+		}
+	}
+	chat.peakClients, chat.peakAt, chat.recordAnnounced = count, times[0], times[1]
+	return nil
+}
+
+// savePeak writes the peak of connected clients, when it was reached and
+// when a record was last announced to PeakFile, if one is configured.
+// The file is replaced whole, so a crash leaves the old peak or the new.
+func (chat *ChatSystem) savePeak() {
+	path := chat.config.PeakFile
+	if path == "" {
+		return
+	}
+
+	// Saves run one at a time, so an older peak cannot overwrite a newer
+	chat.peakFileMu.Lock()
+	defer chat.peakFileMu.Unlock()
+	chat.mu.Lock()
+	data := fmt.Sprintf("%d %s %s\n", chat.peakClients, chat.peakAt.Format(time.RFC3339), chat.recordAnnounced.Format(time.RFC3339))
+	chat.mu.Unlock()
+
+	tmp := path + ".tmp"
+	err := os.WriteFile(tmp, []byte(data), 0o644)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		log.Printf("Error saving the peak of connected clients: %v", err)
+	}
+}
+
+// checkOperPassword reports whether password grants operator privileges.
+func (chat *ChatSystem) checkOperPassword(password string) bool {
+	if chat.config.OperPassword == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(password), []byte(chat.config.OperPassword)) == 1
+}
+
+// notifyOpers sends a message to all connected operators.
+func (chat *ChatSystem) notifyOpers(message string) {
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+	for _, observer := range chat.observers {
+		if client, ok := observer.(*Client); ok && client.oper.Load() {
+			client.notice(message)
+		}
+	}
+}
+
+// findClient looks up a connected client by nickname or by ID ("user:N"
+// or "N"). Nicknames that look like IDs are refused, so a name can only
+// match one way. It must be called with chat.mu held.
+func (chat *ChatSystem) findClient(name string) *Client {
+	for _, observer := range chat.observers {
+		if client, ok := observer.(*Client); ok && client.nick != "" && strings.EqualFold(client.nick, name) {
+			return client
+		}
+	}
+
+	id, err := parseClientID(name)
+	if err != nil {
+		return nil
+	}
+	return chat.clientByID(id)
+}
+
+// nickTaken reports whether a connected client other than exceptID uses
+// nick, compared case-insensitively. It must be called with chat.mu held.
+func (chat *ChatSystem) nickTaken(nick string, exceptID ClientID) bool {
+	for _, observer := range chat.observers {
+		if client, ok := observer.(*Client); ok && client.id != exceptID && strings.EqualFold(client.nick, nick) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientByID looks up a connected client by ID. It must be called with
+// chat.mu held.
+func (chat *ChatSystem) clientByID(id ClientID) *Client {
+	for _, observer := range chat.observers {
+		if client, ok := observer.(*Client); ok && client.id == id {
+			return client
+		}
+	}
+	return nil
+}
+
+// kick disconnects a client, telling it who removed it and why. how is
+// either disconnectKicked or disconnectBanned.
+func (chat *ChatSystem) kick(target *Client, by *Client, reason string, how DisconnectReason) {
+	notice := fmt.Sprintf("You have been %s by %s", how, by.displayName())
+	if reason != "" {
+		notice += ": " + reason
+	}
+	target.notice(notice + "\n")
+	target.Close(how)
+	log.Printf("Client %s %s by %s (%s)", target.id, how, by.id, reason)
+}
+
+// ban bans the address of a client and disconnects it.
+func (chat *ChatSystem) ban(target *Client, by *Client, reason string) {
+	host := remoteHost(target.conn)
+
+	chat.mu.Lock()
+	if chat.bans == nil {
+		chat.bans = make(map[string]bool)
+	}
+	chat.bans[host] = true
+	chat.mu.Unlock()
+
+	log.Printf("Address %s banned by %s", host, by.id)
+	chat.kick(target, by, reason, disconnectBanned)
+}
+
+// warning is a formal warning given to a client by an operator.
+type warning struct {
+	at     time.Time // When the warning was given
+	by     string    // Display name of the operator who gave it
+	reason string    // Why the warning was given
+}
+
+// warn records a warning against target and returns the warnings it was
+// given within the configured window, oldest first. Escalation counts
+// only the warnings of the current session, so clients sharing an
+// address, such as users behind one NAT, do not escalate each other. The
+// warning is also counted against the address, which /warnings reports
+// so operators can spot a client reconnecting to shed its record.
+func (chat *ChatSystem) warn(target *Client, by *Client, reason string) []warning {
+	host := remoteHost(target.conn)
+	now := chat.clock.Now()
+
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+	target.warnings = append(chat.recentWarnings(target, now), warning{at: now, by: by.displayName(), reason: reason})
+	if chat.hostWarnings == nil {
+		chat.hostWarnings = make(map[string][]time.Time)
+	}
+	if _, ok := chat.hostWarnings[host]; !ok && len(chat.hostWarnings) >= maxWarnedHosts {
+		chat.pruneHostWarnings(now)
+	}
+	chat.hostWarnings[host] = append(chat.recentHostWarnings(host, now), now)
+	return slices.Clone(target.warnings)
+}
+
+// recentWarnings returns the warnings given to client within the
+// configured window, dropping older ones. It must be called with chat.mu
+// held.
+func (chat *ChatSystem) recentWarnings(client *Client, now time.Time) []warning {
+	client.warnings = slices.DeleteFunc(client.warnings, func(w warning) bool {
+		return now.Sub(w.at) >= chat.config.WarnWindow
+	})
+	return client.warnings
+}
+
+// pruneHostWarnings makes room for another address in hostWarnings,
+// whose entries outlive the clients that were warned. It drops the
+// addresses whose warnings have all expired and, if the map is still
+// full, the one warned least recently. It must be called with chat.mu
+// held.
+func (chat *ChatSystem) pruneHostWarnings(now time.Time) {
+	var stalest string
+	var stalestAt time.Time
+	for host := range chat.hostWarnings {
+		recent := chat.recentHostWarnings(host, now)
+		if len(recent) == 0 {
+			continue
+		}
+		if last := recent[len(recent)-1]; stalest == "" || last.Before(stalestAt) {
+			stalest, stalestAt = host, last
+		}
+	}
+	if len(chat.hostWarnings) >= maxWarnedHosts {
+		delete(chat.hostWarnings, stalest)
+	}
+}
+
+// recentHostWarnings returns when clients from host were warned within
+// the configured window, dropping older times. It must be called with
+// chat.mu held.
+func (chat *ChatSystem) recentHostWarnings(host string, now time.Time) []time.Time {
+	recent := slices.DeleteFunc(chat.hostWarnings[host], func(at time.Time) bool {
+		return now.Sub(at) >= chat.config.WarnWindow
+	})
+	if len(recent) == 0 {
+		delete(chat.hostWarnings, host)
+		return nil
+	}
+	chat.hostWarnings[host] = recent
+	return recent
+}
+
+// dmPair identifies the private conversation between two clients, with
+// the lower ID first so both directions share one buffer.
+type dmPair struct {
+	a, b ClientID
+}
+
+// newDMPair returns the conversation key for two clients.
+func newDMPair(x, y ClientID) dmPair {
+	if x > y {
+		x, y = y, x
+	}
+	return dmPair{x, y}
+}
+
+// dmEntry is one private message kept for /msgs.
+type dmEntry struct {
+	at   time.Time // When the message was sent
+	from ClientID  // Sender; the other party of the pair received it
+	text string    // Message text
+}
+
+// recordPrivate keeps a private message in the buffer of its conversation,
+// dropping the oldest beyond dmHistorySize.
+func (chat *ChatSystem) recordPrivate(from *Client, to *Client, text string) {
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+	if chat.dms == nil {
+		chat.dms = make(map[dmPair][]dmEntry)
+	}
+	key := newDMPair(from.id, to.id)
+	history := append(chat.dms[key], dmEntry{at: chat.clock.Now(), from: from.id, text: text})
+	if len(history) > dmHistorySize {
+		history = slices.Delete(history, 0, len(history)-dmHistorySize)
+	}
+	chat.dms[key] = history
+}
+
+// forgetPrivate drops every conversation buffer involving a client. It is
+// called when the client disconnects, as its ID will not be seen again.
+func (chat *ChatSystem) forgetPrivate(id ClientID) {
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+	for key := range chat.dms {
+		if key.a == id || key.b == id {
+			delete(chat.dms, key)
+		}
+	}
+}
+
+// sendPrivate delivers a private message from one client to another. When
+// the message went to several clients, group lists all of them.
+func (chat *ChatSystem) sendPrivate(from *Client, to *Client, text string, group []string) {
+	chat.recordPrivate(from, to, text)
+	message := fmt.Sprintf("[private] %s> %s\n", from.displayName(), text)
+	if len(group) > 0 {
+		message = fmt.Sprintf("[private to %s] %s> %s\n", strings.Join(group, ", "), from.displayName(), text)
+	}
+
+	// A private message rings the recipient's bell ahead of the room's
+	// traffic, unless the recipient asked not to be disturbed
+	if to.dnd.Load() {
+		to.Notify(message, from.id)
+		chat.mu.Lock()
+		name := to.displayName()
+		chat.mu.Unlock()
+		from.Notify(fmt.Sprintf("%s is in do-not-disturb\n", name), from.id)
+		return
+	}
+	to.notice(mentionBell + message)
+}
+
+// Errors returned by sendTo
+var (
+	errNoSuchUser  = errors.New("no such user")
+	errSelfMessage = errors.New("cannot send a private message to yourself")
+)
+
+// sendTo delivers a private message from a client to the client with the
+// given nickname, compared case-insensitively, or ID. It returns the
+// recipient's display name.
+func (chat *ChatSystem) sendTo(from *Client, name, text string) (string, error) {
+	chat.mu.Lock()
+	target := chat.findClient(name)
+	if target != nil {
+		name = target.displayName()
+	}
+	chat.mu.Unlock()
+
+	switch {
+	case target == nil:
+		return "", errNoSuchUser
+	case target == from:
+		return "", errSelfMessage
+	}
+	chat.sendPrivate(from, target, text, nil)
+	return name, nil
+}
+
+// isBanned reports whether connections from host are refused.
+func (chat *ChatSystem) isBanned(host string) bool {
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+	return chat.bans[host]
+}
+
+// occupantsLine returns the line telling a joining client who is already
+// connected.
+func (chat *ChatSystem) occupantsLine() string {
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+
+	var names []string
+	for _, observer := range chat.observers {
+		if client, ok := observer.(*Client); ok {
+			names = append(names, client.displayName())
+		}
+	}
+	if len(names) == 0 {
+		return "You're the first one here\n"
+	}
+	return fmt.Sprintf("Currently here: %s\n", strings.Join(names, ", "))
+}
+
+// countMentions returns the number of distinct connected clients that a
+// message, given in lower case, mentions.
+func (chat *ChatSystem) countMentions(lower string) int {
+	if !strings.Contains(lower, "@") {
+		return 0
+	}
+
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+	count := 0
+	for _, observer := range chat.observers {
+		if client, ok := observer.(*Client); ok && client.nick != "" && mentions(lower, client.nick) {
+			count++
+		}
+	}
+	return count
+}
+
+// isQuitCommand reports whether command is one of the configured quit
+// aliases.
+func (chat *ChatSystem) isQuitCommand(command string) bool {
+	return slices.Contains(chat.config.QuitAliases, command)
+}
+
+// isQuitLine reports whether a line the client sent is a quit command.
+func (client *Client) isQuitLine(msg string) bool {
+	if !strings.HasPrefix(msg, "/") {
+		return false
+	}
+	command, _, _ := strings.Cut(msg, " ")
+	return client.chat.isQuitCommand(strings.ToLower(command))
+}
+
+// reconnectHint returns the machine-readable line telling a client that
+// is disconnected for a transient reason how many seconds to wait before
+// reconnecting. The wait grows with the load, so a busy server that
+// restarts or turns clients away is not hit by everyone at once.
+func (chat *ChatSystem) reconnectHint() string {
+	load := float64(chat.clientCount()) / float64(max(chat.config.MaxClients, 1))
+	wait := reconnectBase + time.Duration(min(load, 1)*float64(reconnectMaxExtra))
+	return fmt.Sprintf("reconnect-after: %d\n", int(wait.Seconds()))
+}
+
+// capsLine returns the machine-parsable capability line sent to clients
+// when they connect, listing only the features that are enabled: the
+// commands open to every client, /oper when a password is set, link
+// titles when unfurling is on, and the message length limit, if any.
+func (chat *ChatSystem) capsLine() string {
+	var caps []string
+	for _, cmd := range commands {
+		if cmd.oper || cmd.name == "/oper" && chat.config.OperPassword == "" {
+			continue
+		}
+		caps = append(caps, strings.TrimPrefix(cmd.name, "/"))
+	}
+	if chat.unfurlEnabled.Load() {
+		caps = append(caps, "unfurl")
+	}
+	line := fmt.Sprintf("SMALLCHAT %s caps=%s", protocolVersion, strings.Join(caps, ","))
+	if chat.config.MaxLength > 0 {
+		line += fmt.Sprintf(" maxlen=%d", chat.config.MaxLength)
+	}
+	return line + "\n"
+}
+
+// broadcast sends a message to all connected chat clients except the
+// sender. Server notices use serverSender and reach everyone.
+func (chat *ChatSystem) broadcast(message string, senderID ClientID) {
+	chat.fanOut(message, senderID, nil, true, true)
+}
+
+// broadcastPresence sends a join, leave or nickname notice to everyone.
+// Presence notices are the first traffic shed while the outbound queues
+// are over their high-water mark.
+func (chat *ChatSystem) broadcastPresence(message string) {
+	if chat.overloaded.Load() {
+		chat.shedNotices.Add(1)
+		return
+	}
+	chat.broadcast(message, serverSender)
+}
+
+// BroadcastTo sends a server message to the clients with the given IDs.
+// The message is meant for them, so their subscription filters don't
+// apply.
+func (chat *ChatSystem) BroadcastTo(ids []ClientID, message string) {
+	chat.BroadcastWhere(func(info ObserverInfo) bool {
+		return slices.Contains(ids, info.ID)
+	}, message)
+}
+
+// BroadcastWhere sends a server message to the clients selected by pred,
+// bypassing their subscription filters. pred is called without chat.mu
+// held, on a snapshot of the connected clients, so it may take its time or
+// call back into ChatSystem. Clients that leave in the meantime are
+// skipped, and clients that join are not considered.
+func (chat *ChatSystem) BroadcastWhere(pred func(ObserverInfo) bool, message string) {
+	chat.mu.Lock()
+	var clients []*Client
+	var infos []ObserverInfo
+	for _, observer := range chat.observers {
+		if client, ok := observer.(*Client); ok {
+			clients = append(clients, client)
+			infos = append(infos, client.info())
+		}
+	}
+	chat.mu.Unlock()
+
+	targets := make(map[ChatObserver]bool)
+	for i, info := range infos {
+		if pred(info) {
+			targets[clients[i]] = true
+		}
+	}
+	chat.fanOut(message, serverSender, targets, true, false)
+}
+
+// fanOut delivers a message to every observer but the sender, or only to
+// the observers in targets when it is not nil. Subscription filters apply
+// to everyone but explicit targets. When highlight is set, mentions get
+// through them and ring the mentioned client's bell, unless it is in
+// do-not-disturb. Replay observers receive the message only when
+// replay is set, which targeted and temporary messages leave out. It logs
+// a warning when a single message reaches more recipients than the
+// configured limit, which usually means a send meant for a few clients
+// went to everyone.
+func (chat *ChatSystem) fanOut(message string, senderID ClientID, targets map[ChatObserver]bool, highlight, replay bool) {
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+
+	// Lowercase once for all the subscription filters
+	lower := strings.ToLower(message)
+
+	recipients := 0
+	for _, observer := range chat.observers {
+		if targets != nil && !targets[observer] {
+			continue
+		}
+		if o, ok := observer.(identifiedObserver); ok && senderID != serverSender && o.ID() == senderID {
+			continue
+		}
+		client, isClient := observer.(*Client)
+		if isClient && targets == nil && !client.wants(lower, highlight) {
+			chat.filteredDeliveries.Add(1)
+			continue
+		}
+		if isClient && highlight && !client.dnd.Load() && client.mentionedIn(lower) {
+			observer.Notify(mentionBell+message, senderID)
+		} else {
+			observer.Notify(message, senderID)
+		}
+		recipients++
+	}
+
+	if replay {
+		for _, observer := range chat.replay {
+			observer.Notify(message, senderID)
+		}
+	}
+
+	if limit := chat.config.MaxFanOut; limit > 0 && recipients > limit {
+		log.Printf("Message from %s reached %d recipients, more than the limit of %d", senderID, recipients, limit)
+	}
+}
+
+// Client represents a connected chat client.
+type Client struct {
+	id           ClientID      // Unique client ID
+	nick         string        // Nickname of the client, written under chat.mu
+	conn         net.Conn      // Network connection
+	chat         *ChatSystem   // Reference to the chat system
+	reader       *bufio.Reader // Buffered reader for reading client input
+	reads        *readCounter  // Counts the reads underneath reader
+	readMark     [2]int64      // Reads and bytes counted when the last line was checked
+	pathological bool          // Whether the client's read pattern has been reported
+	reserved     bool          // Whether the client connected into a reserved slot
+	oper         atomic.Bool   // Whether the client authenticated as an operator
+	closing      sync.Once     // Guard to run the disconnect teardown only once
+	closed       atomic.Bool   // Set before the connection is closed; later writes are skipped
+	outbox       *outbox       // Messages waiting to be written by writeLoop
+	done         chan struct{} // Closed by Close to stop writeLoop
+	tooSlow      atomic.Bool   // Set when the outbound queue overflowed
+	dnd          atomic.Bool   // Whether do-not-disturb is on, set with /dnd
+	keywords     []string      // Broadcast filter set with /subscribe, guarded by chat.mu
+	joined       time.Time     // Time the client connected
+	nickChanges  int           // Number of nickname changes in this session
+	received     time.Time     // Time the line being handled was read
+	lastWrite    atomic.Int64  // Time of the last successful write, in Unix nanoseconds
+	lastPost     time.Time     // Time the client last posted a message
+	mutedUntil   atomic.Int64  // End of an escalation mute, in Unix nanoseconds
+	warnings     []warning     // Recent warnings given in this session, guarded by chat.mu
+	newcomer     bool          // Whether a bare "help" is still read as /help, until the first regular message
+	holdMu       sync.Mutex    // Mutex to protect held
+	held         []heldMessage // Messages queued during the new-connection cooldown
+	limitsMu     sync.Mutex    // Mutex to protect the limits and limiters below
+	limits       clientLimits  // Limits in force for this client
+	msgLimit     *rateLimiter  // Limit on lines sent per second
+	byteLimit    *rateLimiter  // Limit on bytes sent per second
+}
+
+// ID returns the client's ID.
+func (client *Client) ID() ClientID {
+	return client.id
+}
+
+// Lanes of a client's outbound queue
+const (
+	laneNormal   = iota // Room messages and presence notices
+	lanePriority        // Private messages, replies and notices meant for the client alone
+	laneLast            // The normal lane, but written only once the priority lane is empty
+)
+
+// outbox is a client's outbound queue. Messages in the priority lane are
+// written before those in the normal lane, except that one normal message
+// is let through after maxPriorityStreak priority ones, so a flood of
+// replies cannot stall the room. Each lane keeps its own order.
+type outbox struct {
+	mu     sync.Mutex         // Mutex to protect the fields below
+	lanes  [2][]queuedMessage // Queued messages, indexed by lane
+	count  int                // Messages queued in both lanes
+	bytes  int                // Bytes queued in both lanes
+	streak int                // Priority messages written since the last normal one
+	closed bool               // Set by discard; later messages are dropped
+	total  *atomic.Int64      // Bytes queued for all clients, shared by their outboxes
+	ready  chan struct{}      // Signalled when a message is queued
+}
+
+// queuedMessage is a message waiting in an outbox lane.
+type queuedMessage struct {
+	text string // The message
+	last bool   // Whether it waits for the priority lane to empty
+}
+
+// newOutbox creates an empty outbound queue that counts the bytes it
+// holds in total as well.
+func newOutbox(total *atomic.Int64) *outbox {
+	return &outbox{total: total, ready: make(chan struct{}, 1)}
+}
+
+// push queues a message in a lane and reports whether there was room for
+// it within outboundQueueSize. Messages pushed after discard are dropped.
+func (box *outbox) push(message string, lane int) bool {
+	box.mu.Lock()
+	if box.closed {
+		box.mu.Unlock()
+		return true
+	}
+	if box.count >= outboundQueueSize {
+		box.mu.Unlock()
+		return false
+	}
+	entry := queuedMessage{text: message}
+	if lane == laneLast {
+		lane, entry.last = laneNormal, true
+	}
+	box.lanes[lane] = append(box.lanes[lane], entry)
+	box.count++
+	box.bytes += len(message)
+	box.total.Add(int64(len(message)))
+	box.mu.Unlock()
+
+	select {
+	case box.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// pop takes the next message to write, reporting false when the queue is
+// empty.
+func (box *outbox) pop() (string, bool) {
+	box.mu.Lock()
+	defer box.mu.Unlock()
+	return box.popLocked()
+}
+
+// popBatch takes the next messages to write, in the order pop would,
+// until they add up to at least max bytes, and returns them joined. The
+// batch is empty when the queue is.
+func (box *outbox) popBatch(max int) []byte {
+	box.mu.Lock()
+	defer box.mu.Unlock()
+	var batch []byte
+	for len(batch) < max {
+		message, ok := box.popLocked()
+		if !ok {
+			break
+		}
+		batch = append(batch, message...)
+	}
+	return batch
+}
+
+// popLocked is pop for callers holding box.mu.
+func (box *outbox) popLocked() (string, bool) {
+	normal := box.lanes[laneNormal]
+	lane := lanePriority
+	if len(box.lanes[lanePriority]) == 0 || (box.streak >= maxPriorityStreak && len(normal) > 0 && !normal[0].last) {
+		lane = laneNormal
+	}
+	queue := box.lanes[lane]
+	if len(queue) == 0 {
+		return "", false
+	}
+	message := queue[0].text
+	queue[0] = queuedMessage{}
+	box.lanes[lane] = queue[1:]
+	box.count--
+	box.bytes -= len(message)
+	box.total.Add(-int64(len(message)))
+	if lane == lanePriority {
+		box.streak++
+	} else {
+		box.streak = 0
+	}
+	return message, true
+}
+
+// len returns the number of messages queued in both lanes.
+func (box *outbox) len() int {
+	box.mu.Lock()
+	defer box.mu.Unlock()
+	return box.count
+}
+
+// size returns the number of bytes queued in both lanes.
+func (box *outbox) size() int {
+	box.mu.Lock()
+	defer box.mu.Unlock()
+	return box.bytes
+}
+
+// finish replaces what is queued with a final message and drops whatever
+// is pushed later, for a client that is to be sent nothing else.
+func (box *outbox) finish(message string) {
+	box.mu.Lock()
+	box.total.Add(int64(len(message) - box.bytes))
+	box.lanes = [2][]queuedMessage{lanePriority: {{text: message}}}
+	box.count, box.bytes = 1, len(message)
+	box.closed = true
+	box.mu.Unlock()
+
+	select {
+	case box.ready <- struct{}{}:
+	default:
+	}
+}
+
+// discard empties the queue and drops whatever is pushed later, for a
+// client whose queued messages will not be written.
+func (box *outbox) discard() {
+	box.mu.Lock()
+	defer box.mu.Unlock()
+	box.total.Add(-int64(box.bytes))
+	box.lanes = [2][]queuedMessage{}
+	box.count, box.bytes = 0, 0
+	box.closed = true
+}
+
+// Notify queues a message for the client's writer and returns without
+// waiting for it to be written, so a slow client cannot hold up the
+// others. Replies to the client's own commands, sent with its own ID, go
+// in the priority lane; everything else waits in the normal lane.
+func (client *Client) Notify(message string, senderID ClientID) {
+	lane := laneNormal
+	if senderID == client.id {
+		lane = lanePriority
+	}
+	client.enqueue(message, lane)
+}
+
+// notice queues a message meant for the client alone, such as a private
+// message or an operator's notice, in the priority lane.
+func (client *Client) notice(message string) {
+	client.enqueue(message, lanePriority)
+}
+
+// enqueue queues a message in a lane of the client's outbound queue. A
+// client whose queue is full is disconnected as too slow.
+func (client *Client) enqueue(message string, lane int) {
+	// Nothing queued after Close would be written
+	if client.closed.Load() {
+		return
+	}
+	if client.outbox.push(message, lane) {
+		client.chat.checkQueuedBytes()
+		return
+	}
+
+	// Report once; more messages arrive before Close runs
+	if client.closed.Load() || !client.tooSlow.CompareAndSwap(false, true) {
+		return
+	}
+	// Notify may run with chat.mu held, so the teardown, which takes the
+	// mutex, happens on its own goroutine
+	log.Printf("Client %s is too slow, %d messages are waiting; disconnecting it", client.id, outboundQueueSize)
+	go client.dropTooSlow()
+}
+
+// dropTooSlow disconnects a client that cannot keep up. What it has not
+// read yet is dropped, so the writer only has the reason, with a
+// reconnect hint, left to send before it closes the connection.
+func (client *Client) dropTooSlow() {
+	client.tooSlow.Store(true)
+	client.outbox.finish(tooSlowMsg + client.chat.reconnectHint())
+	client.Close(disconnectTooSlow)
+}
+
+// writeLoop writes the messages queued by Notify to the connection until
+// the client is closed. It then writes what was queued before Close,
+// within closeFlushTimeout, and closes the connection.
+func (client *Client) writeLoop() {
+	defer client.conn.Close()
+	defer client.outbox.discard()
+	for {
+		select {
+		case <-client.outbox.ready:
+			client.gather()
+			if !client.flush() {
+				return
+			}
+		case <-client.done:
+			client.flush()
+			return
+		}
+	}
+}
+
+// checkQueuedBytes sheds load when the messages queued for all clients
+// grow past MaxQueuedBytes. Over the high-water mark, presence notices
+// are dropped until the queues fall back under the low-water mark; over
+// the limit itself, the slowest clients are disconnected.
+func (chat *ChatSystem) checkQueuedBytes() {
+	limit := int64(chat.config.MaxQueuedBytes)
+	if limit <= 0 {
+		return
+	}
+	queued := chat.queuedBytes.Load()
+	high, low := limit*queueHighWater/100, limit*queueLowWater/100
+	switch {
+	case queued > high && chat.overloaded.CompareAndSwap(false, true):
+		chat.overloads.Add(1)
+		chat.noticeOpersLater(fmt.Sprintf("Outbound queues hold %d bytes, over the high-water mark of %d; presence notices are paused\n", queued, high))
+	case queued < low && chat.overloaded.CompareAndSwap(true, false):
+		chat.noticeOpersLater(fmt.Sprintf("Outbound queues are back under %d bytes; presence notices resume\n", low))
+	}
+	if queued > limit && chat.shedding.CompareAndSwap(false, true) {
+		// Notify may run with chat.mu held, so shedding, which takes
+		// the mutex, happens on its own goroutine
+		go chat.shedLoad()
+	}
+}
+
+// noticeOpersLater logs a message and sends it to the operators from a
+// background task, for callers that may hold chat.mu.
+func (chat *ChatSystem) noticeOpersLater(message string) {
+	log.Print(message)
+	chat.tasks.spawn(func(context.Context) { chat.notifyOpers(message) })
+}
+
+// shedLoad disconnects the slowest decile of clients, as too slow, until
+// the bytes queued for all clients are back within MaxQueuedBytes.
+func (chat *ChatSystem) shedLoad() {
+	limit := int64(chat.config.MaxQueuedBytes)
+	for {
+		shed := chat.shedSlowestDecile()
+		if shed > 0 {
+			message := fmt.Sprintf("Disconnected %d slow clients to bring the outbound queues back within %d bytes\n", shed, limit)
+			log.Print(message)
+			chat.notifyOpers(message)
+		}
+		chat.shedding.Store(false)
+		// Messages queued during the round did not start another
+		if shed == 0 || chat.queuedBytes.Load() <= limit || !chat.shedding.CompareAndSwap(false, true) {
+			break
+		}
+	}
+	chat.checkQueuedBytes()
+}
+
+// shedSlowestDecile disconnects the tenth of the clients with the most
+// bytes queued, at least one, and returns how many it disconnected.
+// Their queues are replaced by the too-slow notice rather than flushed.
+func (chat *ChatSystem) shedSlowestDecile() int {
+	chat.mu.Lock()
+	clients := make([]*Client, 0, len(chat.clients))
+	for client := range chat.clients {
+		clients = append(clients, client)
+	}
+	chat.mu.Unlock()
+
+	sizes := make(map[*Client]int, len(clients))
+	for _, client := range clients {
+		sizes[client] = client.outbox.size()
+	}
+	slices.SortFunc(clients, func(a, b *Client) int { return sizes[b] - sizes[a] })
+	clients = clients[:min(len(clients), (len(clients)+9)/10)]
+	for _, client := range clients {
+		log.Printf("Disconnecting client %s, which has %d bytes queued, to shed load", client.id, sizes[client])
+		chat.shedClients.Add(1)
+		client.dropTooSlow()
+	}
+	return len(clients)
+}
+
+// gather waits up to the configured flush interval for more messages to
+// be queued, so they go out in one write. It returns early once
+// writeBatchSize bytes are waiting or the client is closed.
+func (client *Client) gather() {
+	interval := client.chat.config.FlushInterval
+	if interval <= 0 || client.outbox.size() >= writeBatchSize {
+		return
+	}
+	timer := client.chat.clock.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C():
+			return
+		case <-client.done:
+			return
+		case <-client.outbox.ready:
+			if client.outbox.size() >= writeBatchSize {
+				return
+			}
+		}
+	}
+}
+
+// flush writes the queued messages, in batches of up to writeBatchSize
+// bytes, until the queue is empty and reports whether every write
+// succeeded.
+func (client *Client) flush() bool {
+	for {
+		batch := client.outbox.popBatch(writeBatchSize)
+		if len(batch) == 0 {
+			client.chat.checkQueuedBytes()
+			return true
+		}
+		if !client.write(batch) {
+			return false
+		}
+	}
+}
+
+// write writes a batch of messages to the connection and reports whether
+// it succeeded. A failed write closes the client.
+func (client *Client) write(batch []byte) bool {
+	_, err := client.conn.Write(batch)
+	if err != nil {
+		// Writes failing after Close, for instance past the flush
+		// deadline, are expected
+		if !client.closed.Load() {
+			log.Printf("Error sending message to client %s: %v", client.id, err)
+			client.Close(disconnectWriteError)
+		}
+		return false
+	}
+	client.lastWrite.Store(client.chat.clock.Now().UnixNano())
+	return true
+}
+
+// wants reports whether a broadcast message, given in lower case, passes
+// the client's subscription filter. Mentions of the client get through
+// when highlight is set. It must be called with chat.mu held.
+func (client *Client) wants(lower string, highlight bool) bool {
+	if len(client.keywords) == 0 {
+		return true
+	}
+
+	if highlight && client.mentionedIn(lower) {
+		return true
+	}
+
+	for _, keyword := range client.keywords {
+		if strings.Contains(lower, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// mentionedIn reports whether a message, given in lower case, mentions
+// the client. It must be called with chat.mu held.
+func (client *Client) mentionedIn(lower string) bool {
+	return client.nick != "" && mentions(lower, client.nick)
+}
+
+// info returns the client's ObserverInfo. It must be called with chat.mu
+// held.
+func (client *Client) info() ObserverInfo {
+	return ObserverInfo{ID: client.id, Nick: client.nick, Oper: client.oper.Load()}
+}
+
+// setLimits puts a new set of limits in force, restarting the rate
+// limiters.
+func (client *Client) setLimits(limits clientLimits) {
+	client.limitsMu.Lock()
+	defer client.limitsMu.Unlock()
+	client.limits = limits
+	client.msgLimit = newRateLimiter(limits.msgRate)
+	client.byteLimit = newRateLimiter(limits.byteRate)
+}
+
+// getLimits returns the limits in force for the client.
+func (client *Client) getLimits() clientLimits {
+	client.limitsMu.Lock()
+	defer client.limitsMu.Unlock()
+	return client.limits
+}
+
+// checkLimits applies the client's rate limits to a line it sent,
+// returning the notice explaining why it was rejected, or "" if it may
+// pass. Both limits are checked before either is charged, so a line
+// rejected for its size does not also use up a line.
+func (client *Client) checkLimits(msg string, now time.Time) string {
+	client.limitsMu.Lock()
+	defer client.limitsMu.Unlock()
+
+	if !client.msgLimit.has(1, now) {
+		return "You are sending messages too fast, slow down\n"
+	}
+	if !client.byteLimit.has(float64(len(msg)), now) {
+		return "You are sending too much data, slow down\n"
+	}
+	client.msgLimit.take(1)
+	client.byteLimit.take(float64(len(msg)))
+	return ""
+}
+
+// displayName returns the client's nickname, or its ID if it has none.
+func (client *Client) displayName() string {
+	if client.nick == "" {
+		return client.id.String()
+	}
+	return client.nick
+}
+
+// Close disconnects the client: it leaves the observers list, the others
+// are told it left, and its connection is closed. Only the first call has
+// any effect, so Close is safe to call from any goroutine, any number of
+// times. It must not be called with chat.mu held.
+func (client *Client) Close(reason DisconnectReason) {
+	client.closing.Do(func() {
+		chat := client.chat
+		chat.mu.Lock()
+		delete(chat.clients, client)
+		if chat.disconnects == nil {
+			chat.disconnects = make(map[DisconnectReason]int)
+		}
+		chat.disconnects[reason]++
+		chat.mu.Unlock()
+		if chat.removeObserver(client) && chat.config.LeaveScope != leaveScopeNone {
+			chat.mu.Lock()
+			name := client.displayName()
+			chat.mu.Unlock()
+			chat.broadcastPresence(fmt.Sprintf("* %s left the chat\n", name))
+		}
+		chat.forgetPrivate(client.id)
+		client.closed.Store(true)
+
+		// The writer flushes what is already queued, then closes the
+		// connection, which also ends the read loop. The deadline also
+		// ends a write stuck on a client that stopped reading.
+		client.conn.SetWriteDeadline(time.Now().Add(closeFlushTimeout))
+		close(client.done)
+		log.Printf("Disconnected client clientID=%d reason=%s", client.id, reason)
+	})
+}
+
+// watchHandshake drops the client if it sends no line within timeout, as
+// measured by the chat's clock, by failing its pending read. It returns a
+// function to call once a line has been read, which reports whether it
+// came in time; later calls report the same.
+func (client *Client) watchHandshake(timeout time.Duration) func() bool {
+	if timeout <= 0 {
+		return func() bool { return true }
+	}
+
+	var state atomic.Int32
+	spoke := make(chan struct{})
+	timer := client.chat.clock.NewTimer(timeout)
+	go func() {
+		defer timer.Stop()
+		select {
+		case <-timer.C():
+			if state.CompareAndSwap(handshakeWaiting, handshakeExpired) {
+				// A deadline in the past fails the read at once
+				client.conn.SetReadDeadline(time.Unix(1, 0))
+			}
+		case <-spoke:
+		case <-client.done:
+		}
+	}()
+	return func() bool {
+		if state.CompareAndSwap(handshakeWaiting, handshakeDone) {
+			close(spoke)
+		}
+		return state.Load() == handshakeDone
+	}
+}
+
+// listen listens for messages from the client and handles them.
+func (client *Client) listen() {
+	// Advertise the server capabilities to programmatic clients
+	client.Notify(client.chat.capsLine(), client.id)
+
+	// Drop connections that open but never send anything
+	arrived := client.watchHandshake(client.chat.config.HandshakeTimeout)
+
+	// Clients in a reserved slot must authenticate before anything else
+	if client.reserved {
+		if !client.operHandshake() {
+			client.Close(disconnectServerFull)
+			return
+		}
+		arrived()
+	}
+
+	// Send the welcome message to the client
+	client.Notify(welcomeMessage, client.id)
+
+	if client.chat.config.IdentityPolicy == policyNickRequired {
+		client.Notify(nickRequiredMsg, client.id)
+	}
+
+	if client.chat.config.WelcomeOccupants {
+		client.Notify(client.chat.occupantsLine(), client.id)
+	}
+
+	// Only start receiving broadcasts once the welcome has been written,
+	// so it is always the first thing the client sees. Clients accepted
+	// at the same time may have taken the last slots in the meantime.
+	if !client.chat.tryAddObserver(client) {
+		client.Notify(fullMsg+client.chat.reconnectHint(), client.id)
+		log.Printf("Rejected client %s: server is full", client.id)
+		client.Close(disconnectServerFull)
+		return
+	}
+	client.chat.broadcastPresence(fmt.Sprintf("* %s joined the chat\n", client.id))
+	client.chat.checkRecord()
+
+	reason := disconnectQuit
+	for {
+		// Read a message from the client
+		msg, err := client.readLine()
+		if errors.Is(err, errLineTooLong) {
+			client.Notify(fmt.Sprintf("Line too long, the limit is %d bytes\n", maxLineLength), client.id)
+			continue
+		}
+		// A line racing the handshake timeout is dropped with the client
+		if !arrived() {
+			log.Printf("Client %s sent nothing during the handshake, dropping it", client.id)
+			reason = disconnectHandshakeTimeout
+			break
+		}
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Error reading from client %s: %v", client.id, err)
+				reason = disconnectReadError
+			}
+			break
+		}
+
+		client.received = client.chat.clock.Now()
+
+		client.checkReadPattern(len(msg))
+
+		// Remove any potential carriage return characters. The line is
+		// complete here, so runes split across reads are whole again and
+		// any bytes still invalid were sent that way.
+		msg = strings.ReplaceAll(msg, "\r", "")
+		msg = strings.ToValidUTF8(msg, "\uFFFD")
+
+		// Handle commands
+		client.handleCommand(msg)
+	}
+
+	// Remove the client from the chat. If it was closed elsewhere, that
+	// earlier reason is the one recorded.
+	client.Close(reason)
+}
+
+// checkReadPattern looks at how a line of lineLen bytes arrived and
+// reports clients that send their lines a byte or two per packet, which
+// works but wastes a syscall per byte. Each client is reported once.
+func (client *Client) checkReadPattern(lineLen int) {
+	reads, bytes := client.reads.reads.Load(), client.reads.bytes.Load()
+	lineReads := reads - client.readMark[0]
+	lineBytes := bytes - client.readMark[1]
+	client.readMark = [2]int64{reads, bytes}
+
+	if client.pathological || lineLen < pathologicalLineMin || lineReads == 0 {
+		return
+	}
+	if float64(lineBytes)/float64(lineReads) < pathologicalBytesPerRead {
+		client.pathological = true
+		client.chat.pathologicalReads.Add(1)
+		log.Printf("Client %s sends tiny packets: %d reads for a %d byte line", client.id, lineReads, lineLen)
+	}
+}
+
+// errLineTooLong is returned by readLine for a line that was discarded.
+var errLineTooLong = errors.New("line too long")
+
+// readLine reads the next line from the client. A line longer than
+// maxLineLength is read to its end and discarded, so a client cannot make
+// the server buffer without bound, and errLineTooLong is returned.
+func (client *Client) readLine() (string, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := client.reader.ReadSlice('\n')
+		if !tooLong && len(line)+len(chunk) > maxLineLength {
+			tooLong = true
+			line = nil
+		}
+		if !tooLong {
+			line = append(line, chunk...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if tooLong && err == nil {
+			return "", errLineTooLong
+		}
+		return string(line), err
+	}
+}
+
+// operHandshake asks a client in a reserved slot to authenticate as an
+// operator and reports whether it succeeded.
+func (client *Client) operHandshake() bool {
+	client.Notify(reservedMsg, client.id)
+
+	msg, err := client.readLine()
+	if err != nil {
+		return false
+	}
+
+	parts := splitArgs(strings.TrimSpace(msg))
+	if strings.ToLower(parts[0]) != "/oper" || len(parts) != 2 || !client.chat.checkOperPassword(parts[1]) {
+		client.Notify("Not authorized\n"+client.chat.reconnectHint(), client.id)
+		return false
+	}
+
+	client.oper.Store(true)
+	log.Printf("Client %s authenticated as operator", client.id)
+	return true
+}
+
+// handleCommand handles commands sent by the client.
+func (client *Client) handleCommand(msg string) {
+	// Trim only trailing whitespace, so indented code keeps its
+	// indentation. A command must start at the first character: a line
+	// such as " /nick" is a regular message.
+	msg = strings.TrimRightFunc(msg, unicode.IsSpace)
+
+	// Check if the message is empty
+	if strings.TrimSpace(msg) == "" {
+		// Ignore empty messages (e.g., when clients just hit enter)
+		return
+	}
+
+	// Throttle clients that send too many lines or too many bytes, but
+	// always let them leave
+	if !client.isQuitLine(msg) {
+		if reject := client.checkLimits(msg, client.chat.clock.Now()); reject != "" {
+			client.chat.droppedMessages.Add(1)
+			client.Notify(reject, client.id)
+			return
+		}
+	}
+
+	// Check if the message is a command
+	if strings.HasPrefix(msg, "/") {
+		parts := splitArgs(msg)
+		command := strings.ToLower(parts[0])
+		client.chat.usage.countCommand(command)
+
+		if cmd := lookupCommand(command); cmd != nil {
+			cmd.run(client, parts)
+		} else if client.chat.isQuitCommand(command) {
+			client.handleQuitCommand()
+			return
+		} else {
+			// Handle unknown commands
+			client.Notify(unknownCmdMsg, client.id)
+		}
+	} else {
+		// New users often type "help" without the slash; answer it instead
+		// of broadcasting it, until they have picked a nick or posted
+		if client.newcomer && client.nick == "" && isHelpWord(msg) {
+			client.Notify("Commands start with a slash, so \"/help\" is what you were after.\n", client.id)
+			client.handleHelpCommand([]string{"/help"})
+			return
+		}
+		client.newcomer = false
+		client.postMessage(msg, "", false)
+	}
+}
+
+// postMessage runs a regular message through the posting checks and
+// broadcasts it, or queues it during the join cooldown. label, if set,
+// precedes the line as recipients see it. A temporary message is kept
+// nowhere: not by replay observers and not in the link title cache. It
+// reports whether the message was accepted.
+func (client *Client) postMessage(msg, label string, temporary bool) bool {
+	if !client.mayMessage() {
+		return false
+	}
+
+	if max := client.getLimits().maxLength; max > 0 && len(msg) > max {
+		client.chat.droppedMessages.Add(1)
+		client.Notify(fmt.Sprintf("Message too long, the limit is %d bytes\n", max), client.id)
+		return false
+	}
+
+	if reject := client.checkQuietHours(client.chat.clock.Now()); reject != "" {
+		client.chat.droppedMessages.Add(1)
+		client.Notify(reject, client.id)
+		return false
+	}
+	client.lastPost = client.chat.clock.Now()
+
+	msg = client.maskSecrets(msg)
+
+	// Guard against messages ringing everyone's bell. Operators are
+	// exempt so they can address everyone in announcements.
+	highlight := true
+	if !client.oper.Load() {
+		mentioned := client.chat.countMentions(strings.ToLower(msg))
+		if reject := client.chat.config.RejectMentions; reject > 0 && mentioned > reject {
+			client.chat.droppedMessages.Add(1)
+			client.Notify(fmt.Sprintf("Message mentions %d users, the limit is %d\n", mentioned, reject), client.id)
+			return false
+		}
+		if max := client.chat.config.MaxMentions; max > 0 && mentioned > max {
+			highlight = false
+		}
+	}
+
+	// Regular message broadcasting
+	displayMsg := fmt.Sprintf("%s%s> %s\n", label, client.displayName(), msg)
+	post := heldMessage{display: displayMsg, text: msg, highlight: highlight, temporary: temporary}
+	if !client.holdForCooldown(post) {
+		client.post(post)
+	}
+	return true
+}
+
+// mayMessage applies the checks shared by public and private messages and
+// reports whether the client may send one, telling it why when it may not.
+func (client *Client) mayMessage() bool {
+	// Enforce the server identity policy
+	if client.chat.config.IdentityPolicy == policyNickRequired && client.nick == "" {
+		client.chat.droppedMessages.Add(1)
+		client.Notify(nickRequiredMsg, client.id)
+		return false
+	}
+
+	if wait := time.Duration(client.mutedUntil.Load() - client.chat.clock.Now().UnixNano()); wait > 0 {
+		client.chat.droppedMessages.Add(1)
+		client.Notify(fmt.Sprintf("You are muted for another %s\n", formatDuration(wait.Round(time.Second))), client.id)
+		return false
+	}
+	return true
+}
+
+// mayMessagePrivately runs the mayMessage checks for a private message.
+// Private messages are never queued during the new-connection cooldown,
+// whatever the policy, as they would arrive long after the conversation
+// they belong to; they are rejected instead.
+func (client *Client) mayMessagePrivately() bool {
+	if !client.mayMessage() {
+		return false
+	}
+	if wait := client.cooldownWait(); wait > 0 {
+		client.chat.droppedMessages.Add(1)
+		client.Notify(fmt.Sprintf("Please wait %s before sending private messages, new connections have a cooldown\n", formatWait(wait)), client.id)
+		return false
+	}
+	return true
+}
+
+// maskSecrets masks the secrets in a message the client is sending and
+// tells the client privately when it did.
+func (client *Client) maskSecrets(msg string) string {
+	msg, masked := client.chat.maskSecrets(msg)
+	if masked > 0 {
+		client.Notify("Your message looked like it contained a secret, which was masked. If it was real, rotate it.\n", client.id)
+	}
+	return msg
+}
+
+// handleTempCommand handles the /temp command, which posts a message that
+// the server doesn't keep anywhere once it is delivered.
+func (client *Client) handleTempCommand(parts []string) {
+	usage := "Usage: /temp <seconds> <message>\n"
+	if len(parts) != 2 {
+		client.Notify(usage, client.id)
+		return
+	}
+
+	args := splitArgs(parts[1])
+	seconds, err := strconv.Atoi(args[0])
+	if len(args) != 2 || err != nil || seconds <= 0 || seconds > maxTempSeconds {
+		client.Notify(usage, client.id)
+		return
+	}
+
+	lifetime := formatDuration(time.Duration(seconds) * time.Second)
+	if client.postMessage(args[1], fmt.Sprintf("[temp %s] ", lifetime), true) {
+		client.Notify(fmt.Sprintf("Posted as temporary for %s. The server keeps no copy, but it cannot take the text back from screens that already show it.\n", lifetime), client.id)
+	}
+}
+
+// heldMessage is a regular message ready to be broadcast.
+type heldMessage struct {
+	display   string // Line as recipients see it
+	text      string // Message text, for unfurling
+	highlight bool   // Whether mentions get through subscription filters
+	temporary bool   // Whether the message must not be kept, posted with /temp
+}
+
+// post broadcasts a regular message from the client.
+func (client *Client) post(msg heldMessage) {
+	client.chat.fanOut(msg.display, client.id, nil, msg.highlight, !msg.temporary)
+
+	// Post the title of the first link, if unfurling is on. Temporary
+	// messages are skipped, as the link would stay in the cache.
+	if client.chat.unfurlEnabled.Load() && !msg.temporary {
+		client.chat.unfurler.unfurl(msg.text, client.chat)
+	}
+}
+
+// holdForCooldown applies the new-connection cooldown to a message and
+// reports whether it was held back. Under the reject policy the client is
+// told to wait; under the queue policy the message is kept and posted when
+// the cooldown ends. Messages sent while earlier ones are still queued are
+// queued too, so they are posted in order, up to maxHeldMessages; the
+// client is told about the queue once, and about every message past the
+// limit, which is dropped. Operators are exempt.
+func (client *Client) holdForCooldown(msg heldMessage) bool {
+	chat := client.chat
+	if client.oper.Load() || chat.config.JoinCooldown <= 0 {
+		return false
+	}
+
+	client.holdMu.Lock()
+	defer client.holdMu.Unlock()
+
+	wait := client.cooldownWait()
+	if wait == 0 && len(client.held) == 0 {
+		return false
+	}
+	waitText := formatWait(wait)
+
+	if chat.config.CooldownPolicy == cooldownReject {
+		chat.droppedMessages.Add(1)
+		client.Notify(fmt.Sprintf("Please wait %s before posting, new connections have a cooldown\n", waitText), client.id)
+		return true
+	}
+
+	if len(client.held) >= maxHeldMessages {
+		chat.droppedMessages.Add(1)
+		client.Notify(fmt.Sprintf("Too many messages waiting for the new-connection cooldown, please wait %s before posting more\n", waitText), client.id)
+		return true
+	}
+
+	first := len(client.held) == 0
+	if first {
+		release := chat.clock.NewTimer(wait)
+		chat.tasks.spawn(func(ctx context.Context) {
+			select {
+			case <-release.C():
+				client.releaseHeld()
+			case <-ctx.Done():
+				release.Stop()
+			}
+		})
+	}
+	client.held = append(client.held, msg)
+	if first {
+		client.Notify(fmt.Sprintf("Your messages will be posted when the new-connection cooldown ends in %s\n", waitText), client.id)
+	}
+	return true
+}
+
+// cooldownWait returns how long the new-connection cooldown still lasts
+// for the client, or zero once it is over or for operators.
+func (client *Client) cooldownWait() time.Duration {
+	if client.oper.Load() || client.chat.config.JoinCooldown <= 0 {
+		return 0
+	}
+	return max(client.chat.config.JoinCooldown-client.chat.clock.Now().Sub(client.joined), 0)
+}
+
+// formatWait formats a cooldown wait, rounded up so the client is never
+// told to wait "0ms".
+func formatWait(wait time.Duration) string {
+	return formatDuration((wait + time.Second - 1).Truncate(time.Second))
+}
+
+// releaseHeld posts the messages queued during the new-connection
+// cooldown, unless the client has left in the meantime.
+func (client *Client) releaseHeld() {
+	client.holdMu.Lock()
+	defer client.holdMu.Unlock()
+	held := client.held
+	client.held = nil
+	if client.closed.Load() {
+		return
+	}
+	for _, msg := range held {
+		client.post(msg)
+	}
+}
+
+// checkQuietHours applies the quiet hours policy to a message the client
+// wants to post, returning the notice explaining why it was rejected, or
+// "" if it may pass. Operators are exempt.
+func (client *Client) checkQuietHours(now time.Time) string {
+	quiet := client.chat.quietHours
+	if client.oper.Load() || !quiet.active(now) {
+		return ""
+	}
+
+	switch quiet.policy {
+	case quietReadOnly:
+		return "Quiet hours: only operators may post right now\n"
+	case quietSlow:
+		if wait := quietSlowInterval - now.Sub(client.lastPost); wait > 0 {
+			return fmt.Sprintf("Quiet hours: slow mode is on, wait %s before posting again\n", formatDuration(wait.Round(time.Second)))
+		}
+	}
+	return ""
+}
+
+// handleNickCommand handles the /nick command to set a client's nickname.
+func (client *Client) handleNickCommand(parts []string) {
+	if len(parts) != 2 {
+		client.Notify("Usage: /nick <nickname>\n", client.id)
+		return
+	}
+
+	newNick := strings.TrimSpace(parts[1])
+	if newNick == "" {
+		client.Notify("Nickname cannot be empty\n", client.id)
+		return
+	}
+
+	// A nickname must be one word, or /msg and recipient lists could not
+	// address it, and must not pass for a client ID, or its owner could
+	// impersonate an anonymous client
+	if strings.ContainsFunc(newNick, func(r rune) bool { return unicode.IsSpace(r) || r == ',' }) {
+		client.Notify("Nickname cannot contain spaces or commas\n", client.id)
+		return
+	}
+	if _, err := parseClientID(strings.ToLower(newNick)); err == nil {
+		client.Notify("Nickname cannot look like a client ID\n", client.id)
+		return
+	}
+
+	// Operators are exempt from the per-session limit. Setting the first
+	// nickname is not a change.
+	limit := client.chat.config.MaxNickChanges
+	if limit > 0 && !client.oper.Load() && client.nickChanges >= limit {
+		client.Notify(fmt.Sprintf("You cannot change your nickname more than %d times per session\n", limit), client.id)
+		return
+	}
+
+	// Other clients read nicknames under the mutex, so check and set it
+	// there too
+	chat := client.chat
+	chat.mu.Lock()
+	if chat.nickTaken(newNick, client.id) {
+		chat.mu.Unlock()
+		client.Notify("Nickname already in use\n", client.id)
+		return
+	}
+	oldNick := client.nick
+	client.nick = newNick
+	chat.mu.Unlock()
+	chat.nickChanged(client.id, oldNick, newNick)
+
+	if oldNick != "" && oldNick != newNick {
+		client.nickChanges++
+	}
+	client.chat.usage.countNick(newNick)
+	notifyMsg := fmt.Sprintf("%s is now known as %s\n", client.id, client.nick)
+	log.Print(notifyMsg)
+	client.chat.broadcastPresence(notifyMsg)
+}
+
+// handleOperCommand handles the /oper command to gain operator privileges.
+func (client *Client) handleOperCommand(parts []string) {
+	if len(parts) != 2 {
+		client.Notify("Usage: /oper <password>\n", client.id)
+		return
+	}
+
+	if !client.chat.checkOperPassword(strings.TrimSpace(parts[1])) {
+		client.Notify("Not authorized\n", client.id)
+		return
+	}
+
+	client.oper.Store(true)
+	log.Printf("Client %s authenticated as operator", client.id)
+	client.Notify("You are now an operator\n", client.id)
+}
+
+// handleWhoisCommand handles the /whois command, which shows information
+// about a client given its nickname or ID.
+func (client *Client) handleWhoisCommand(parts []string) {
+	if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+		client.Notify("Usage: /whois <nickname|id>\n", client.id)
+		return
+	}
+
+	name := strings.TrimSpace(parts[1])
+
+	chat := client.chat
+	chat.mu.Lock()
+	target := chat.findClient(name)
+	var info string
+	if target != nil {
+		nick := target.nick
+		if nick == "" {
+			nick = "(no nick)"
+		}
+		info = fmt.Sprintf("%s: %s, connected since %s (%s ago)", target.id, nick,
+			target.joined.Format(time.DateTime), formatDuration(client.chat.clock.Now().Sub(target.joined)))
+		if target.oper.Load() {
+			info += ", operator"
+		}
+		if limits := target.getLimits(); limits.overridden {
+			info += ", limits " + limits.String()
+		}
+		if reads := target.reads.reads.Load(); reads > 0 {
+			info += fmt.Sprintf(", %.1f bytes per read", float64(target.reads.bytes.Load())/float64(reads))
+		}
+	}
+	chat.mu.Unlock()
+
+	if target == nil {
+		client.Notify(fmt.Sprintf("No such user: %s\n", name), client.id)
+		return
+	}
+	client.Notify(info+"\n", client.id)
+}
+
+// handlePingCommand handles the /ping command. It replies straight away
+// with the time the server spent on the line, echoing back an optional
+// token so scripted clients can match replies and measure round trips.
+func (client *Client) handlePingCommand(parts []string) {
+	elapsed := client.chat.clock.Now().Sub(client.received)
+	reply := "pong"
+	if len(parts) == 2 && strings.TrimSpace(parts[1]) != "" {
+		reply += " " + strings.TrimSpace(parts[1])
+	}
+	// The pong waits behind everything already queued, so it measures
+	// the whole queue and scripts can use it to wait for earlier replies
+	client.enqueue(fmt.Sprintf("%s (server processed in %.1fms)\n", reply, float64(elapsed.Microseconds())/1000), laneLast)
+}
+
+// handleLagCommand handles the operator /lag command, which reports how
+// long ago a client was last written to successfully.
+func (client *Client) handleLagCommand(parts []string) {
+	if !client.oper.Load() {
+		client.Notify("Permission denied\n", client.id)
+		return
+	}
+
+	if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+		client.Notify("Usage: /lag <nickname|id>\n", client.id)
+		return
+	}
+
+	name := strings.TrimSpace(parts[1])
+
+	chat := client.chat
+	chat.mu.Lock()
+	target := chat.findClient(name)
+	chat.mu.Unlock()
+
+	if target == nil {
+		client.Notify(fmt.Sprintf("No such user: %s\n", name), client.id)
+		return
+	}
+
+	// The queue depth shows a client falling behind before it is
+	// disconnected as too slow
+	queued := fmt.Sprintf("%d of %d messages queued", target.outbox.len(), outboundQueueSize)
+	lastWrite := target.lastWrite.Load()
+	if lastWrite == 0 {
+		client.Notify(fmt.Sprintf("%s: %s, nothing written yet\n", target.id, queued), client.id)
+		return
+	}
+	since := client.chat.clock.Now().Sub(time.Unix(0, lastWrite))
+	client.Notify(fmt.Sprintf("%s: %s, last successful write %s ago\n", target.id, queued, formatDuration(since)), client.id)
+}
+
+// handleKickIDCommand handles the operator /kickid and /banid commands,
+// which remove a client given its ID. This lets operators deal with
+// anonymous clients that have no nickname to target.
+func (client *Client) handleKickIDCommand(parts []string, ban bool) {
+	usage := "Usage: /kickid <id> [reason]\n"
+	if ban {
+		usage = "Usage: /banid <id> [reason]\n"
+	}
+
+	if !client.oper.Load() {
+		client.Notify("Permission denied\n", client.id)
+		return
+	}
+
+	if len(parts) != 2 {
+		client.Notify(usage, client.id)
+		return
+	}
+
+	args := splitArgs(strings.TrimSpace(parts[1]))
+	id, err := parseClientID(args[0])
+	if err != nil {
+		client.Notify(usage, client.id)
+		return
+	}
+
+	reason := ""
+	if len(args) == 2 {
+		reason = strings.TrimSpace(args[1])
+	}
+
+	chat := client.chat
+	chat.mu.Lock()
+	target := chat.clientByID(id)
+	chat.mu.Unlock()
+
+	if target == nil {
+		client.Notify(fmt.Sprintf("No such user: %s\n", id), client.id)
+		return
+	}
+
+	if ban {
+		chat.ban(target, client, reason)
+		client.Notify(fmt.Sprintf("Banned %s\n", id), client.id)
+	} else {
+		chat.kick(target, client, reason, disconnectKicked)
+		client.Notify(fmt.Sprintf("Kicked %s\n", id), client.id)
+	}
+}
+
+// handleWarnCommand handles the operator /warn command, which formally
+// warns a client. Repeated warnings escalate to a mute and then a kick,
+// at the thresholds set in the config.
+func (client *Client) handleWarnCommand(parts []string) {
+	usage := "Usage: /warn <nickname|id> <reason>\n"
+	if !client.oper.Load() {
+		client.Notify("Permission denied\n", client.id)
+		return
+	}
+
+	if len(parts) != 2 {
+		client.Notify(usage, client.id)
+		return
+	}
+
+	args := splitArgs(parts[1])
+	if len(args) != 2 {
+		client.Notify(usage, client.id)
+		return
+	}
+
+	chat := client.chat
+	chat.mu.Lock()
+	target := chat.findClient(args[0])
+	var name string
+	if target != nil {
+		name = target.displayName()
+	}
+	chat.mu.Unlock()
+
+	if target == nil {
+		client.Notify(fmt.Sprintf("No such user: %s\n", args[0]), client.id)
+		return
+	}
+
+	reason := args[1]
+	count := len(chat.warn(target, client, reason))
+	target.notice(fmt.Sprintf("Warning from %s: %s\n", client.displayName(), reason))
+	log.Printf("Client %s warned by %s (%s), %d recent warnings", target.id, client.id, reason, count)
+
+	switch {
+	case chat.config.WarnKick > 0 && count >= chat.config.WarnKick:
+		chat.kick(target, client, fmt.Sprintf("%d warnings", count), disconnectKicked)
+		client.Notify(fmt.Sprintf("Warned %s (%d warnings), kicked\n", name, count), client.id)
+	case chat.config.WarnMute > 0 && count >= chat.config.WarnMute:
+		mute := chat.config.MuteDuration
+		target.mutedUntil.Store(chat.clock.Now().Add(mute).UnixNano())
+		target.notice(fmt.Sprintf("You have been muted for %s after %d warnings\n", formatDuration(mute), count))
+		log.Printf("Client %s muted for %v after %d warnings", target.id, mute, count)
+		client.Notify(fmt.Sprintf("Warned %s (%d warnings), muted for %s\n", name, count, formatDuration(mute)), client.id)
+	default:
+		client.Notify(fmt.Sprintf("Warned %s (%d warnings)\n", name, count), client.id)
+	}
+}
+
+// handleWarningsCommand handles the operator /warnings command, which shows
+// the recent warnings given to a client, and how many went to other
+// clients from its address.
+func (client *Client) handleWarningsCommand(parts []string) {
+	if !client.oper.Load() {
+		client.Notify("Permission denied\n", client.id)
+		return
+	}
+
+	if len(parts) != 2 {
+		client.Notify("Usage: /warnings <nickname|id>\n", client.id)
+		return
+	}
+
+	chat := client.chat
+	name := strings.TrimSpace(parts[1])
+	chat.mu.Lock()
+	target := chat.findClient(name)
+	var recent []warning
+	var host string
+	var others int
+	if target != nil {
+		now := chat.clock.Now()
+		name = target.displayName()
+		recent = slices.Clone(chat.recentWarnings(target, now))
+		host = remoteHost(target.conn)
+		others = len(chat.recentHostWarnings(host, now)) - len(recent)
+	}
+	chat.mu.Unlock()
+
+	if target == nil {
+		client.Notify(fmt.Sprintf("No such user: %s\n", name), client.id)
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s has %d warnings in the last %s\n", name, len(recent), formatDuration(chat.config.WarnWindow))
+	for _, w := range recent {
+		fmt.Fprintf(&b, "  %s by %s: %s\n", w.at.Format(time.DateTime), w.by, w.reason)
+	}
+	if others > 0 {
+		fmt.Fprintf(&b, "%d more warnings went to other clients from %s\n", others, host)
+	}
+	client.Notify(b.String(), client.id)
+}
+
+// handleStatsCommand handles the operator /stats command, which reports
+// server counters.
+func (client *Client) handleStatsCommand() {
+	if !client.oper.Load() {
+		client.Notify("Permission denied\n", client.id)
+		return
+	}
+
+	chat := client.chat
+	var stats strings.Builder
+	fmt.Fprintf(&stats, "Connected clients: %d\n", chat.clientCount())
+	chat.mu.Lock()
+	if chat.peakClients > 0 {
+		fmt.Fprintf(&stats, "Peak clients: %d, reached %s ago\n", chat.peakClients, formatDuration(chat.clock.Now().Sub(chat.peakAt)))
+	}
+	fmt.Fprintf(&stats, "Connections reaped: %d idle in handshake, %d too slow, %d write errors\n",
+		chat.disconnects[disconnectHandshakeTimeout], chat.disconnects[disconnectTooSlow], chat.disconnects[disconnectWriteError])
+	chat.mu.Unlock()
+	fmt.Fprintf(&stats, "Accept pauses (out of file descriptors): %d\n", chat.fdExhaustions.Load())
+	fmt.Fprintf(&stats, "Messages dropped: %d\n", chat.droppedMessages.Load())
+	fmt.Fprintf(&stats, "Deliveries filtered by subscriptions: %d\n", chat.filteredDeliveries.Load())
+	fmt.Fprintf(&stats, "Secrets masked: %d\n", chat.maskedSecrets.Load())
+	fmt.Fprintf(&stats, "Clients sending tiny packets: %d\n", chat.pathologicalReads.Load())
+	fmt.Fprintf(&stats, "Outbound bytes queued: %d\n", chat.queuedBytes.Load())
+	fmt.Fprintf(&stats, "Outbound queue overloads: %d\n", chat.overloads.Load())
+	fmt.Fprintf(&stats, "Presence notices shed: %d\n", chat.shedNotices.Load())
+	fmt.Fprintf(&stats, "Clients disconnected over the outbound queue limit: %d\n", chat.shedClients.Load())
+	chat.usage.report(&stats)
+	chat.mu.report(&stats, "Chat lock")
+	client.Notify(stats.String(), client.id)
+}
+
+// handleMsgManyCommand handles the /msgmany command, which privately
+// sends one message to several users and reports who was found.
+func (client *Client) handleMsgManyCommand(parts []string) {
+	usage := "Usage: /msgmany <nick1,nick2,...> <message>\n"
+	if len(parts) != 2 {
+		client.Notify(usage, client.id)
+		return
+	}
+
+	args := splitArgs(strings.TrimSpace(parts[1]))
+	if len(args) != 2 || strings.TrimSpace(args[1]) == "" {
+		client.Notify(usage, client.id)
+		return
+	}
+	if !client.mayMessagePrivately() {
+		return
+	}
+	client.sendGroup(args[0], client.maskSecrets(strings.TrimSpace(args[1])), usage)
+}
+
+// sendGroup privately sends text to the clients in a comma-separated list
+// of nicknames or IDs and tells the sender who was found. usage is the
+// reply when the list names no one to send to.
+func (client *Client) sendGroup(list, text, usage string) {
+	chat := client.chat
+	found, delivered, missing := chat.parseRecipients(client, list)
+	if len(found) > maxRecipients {
+		client.Notify(fmt.Sprintf("Too many recipients, the limit is %d\n", maxRecipients), client.id)
+		return
+	}
+
+	// Recipients of a group note see who else got it
+	var group []string
+	if len(found) > 1 {
+		group = delivered
+	}
+	for _, target := range found {
+		chat.sendPrivate(client, target, text, group)
+	}
+
+	var report []string
+	if len(delivered) > 0 {
+		report = append(report, "delivered to "+strings.Join(delivered, ", "))
+	}
+	if len(missing) > 0 {
+		report = append(report, "not found: "+strings.Join(missing, ", "))
+	}
+	if len(report) == 0 {
+		client.Notify(usage, client.id)
+		return
+	}
+	client.Notify("Message "+strings.Join(report, "; ")+"\n", client.id)
+}
+
+// handleMsgsCommand handles the /msgs command, which replays the client's
+// recent private conversation with another client. Conversations are kept
+// by client ID, so they survive nickname changes on either side.
+func (client *Client) handleMsgsCommand(parts []string) {
+	if len(parts) != 2 {
+		client.Notify("Usage: /msgs <nickname|id>\n", client.id)
+		return
+	}
+
+	chat := client.chat
+	name := strings.TrimSpace(parts[1])
+	chat.mu.Lock()
+	target := chat.findClient(name)
+	var history []dmEntry
+	if target != nil {
+		history = slices.Clone(chat.dms[newDMPair(client.id, target.id)])
+		name = target.displayName()
+	}
+	chat.mu.Unlock()
+
+	if target == nil {
+		client.Notify(fmt.Sprintf("No such user: %s\n", name), client.id)
+		return
+	}
+	if len(history) == 0 {
+		client.Notify(fmt.Sprintf("No private messages with %s\n", name), client.id)
+		return
+	}
+
+	var b strings.Builder
+	for _, entry := range history {
+		from := client.displayName()
+		if entry.from != client.id {
+			from = name
+		}
+		fmt.Fprintf(&b, "[%s] %s> %s\n", entry.at.Format(time.TimeOnly), from, entry.text)
+	}
+	client.Notify(b.String(), client.id)
+}
+
+// handleMsgCommand handles the /msg command, which sends a private message
+// to a client given its nickname or ID, or to a comma-separated list of
+// them.
+func (client *Client) handleMsgCommand(parts []string) {
+	usage := "Usage: /msg <nickname|id>[,...] <message>\n"
+	if len(parts) != 2 {
+		client.Notify(usage, client.id)
+		return
+	}
+
+	args := splitArgs(parts[1])
+	if len(args) != 2 {
+		client.Notify(usage, client.id)
+		return
+	}
+
+	if !client.mayMessagePrivately() {
+		return
+	}
+	text := client.maskSecrets(args[1])
+	if strings.Contains(args[0], ",") {
+		client.sendGroup(args[0], text, usage)
+		return
+	}
+	name, err := client.chat.sendTo(client, args[0], text)
+	if err != nil {
+		client.Notify(fmt.Sprintf("Cannot message %s: %v\n", args[0], err), client.id)
+		return
+	}
+	client.Notify(fmt.Sprintf("[private to %s] %s\n", name, text), client.id)
+}
+
+// handleWhoCommand handles the /who command, which lists the connected
+// clients, sorted by ID, to the requesting client only.
+func (client *Client) handleWhoCommand() {
+	chat := client.chat
+	chat.mu.Lock()
+	var clients []ObserverInfo
+	for _, observer := range chat.observers {
+		if c, ok := observer.(*Client); ok {
+			clients = append(clients, c.info())
+		}
+	}
+	chat.mu.Unlock()
+
+	slices.SortFunc(clients, func(a, b ObserverInfo) int { return int(a.ID) - int(b.ID) })
+
+	var b strings.Builder
+	for _, info := range clients {
+		nick := info.Nick
+		if nick == "" {
+			nick = "(no nick)"
+		}
+		fmt.Fprintf(&b, "%s %s\n", info.ID, nick)
+	}
+	fmt.Fprintf(&b, "Total: %d\n", len(clients))
+	client.Notify(b.String(), client.id)
+}
+
+// parseRecipients resolves a comma-separated list of nicknames or IDs to
+// connected clients. Duplicates, including the same client named twice in
+// different ways, and the sender itself are dropped. It returns the
+// clients found with their display names, and the names not found.
+func (chat *ChatSystem) parseRecipients(sender *Client, list string) (found []*Client, names, missing []string) {
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		target := chat.findClient(name)
+		if target == nil {
+			if !slices.ContainsFunc(missing, func(m string) bool { return strings.EqualFold(m, name) }) {
+				missing = append(missing, name)
+			}
+			continue
+		}
+		if target != sender && !slices.Contains(found, target) {
+			found = append(found, target)
+			names = append(names, target.displayName())
+		}
+	}
+	return found, names, missing
+}
+
+// handleHelpCommand handles the /help command. Without an argument it
+// lists the commands available to the client; with one it shows the usage
+// and description of that command.
+func (client *Client) handleHelpCommand(parts []string) {
+	if len(parts) == 2 {
+		name := strings.ToLower(strings.TrimSpace(parts[1]))
+		if !strings.HasPrefix(name, "/") {
+			name = "/" + name
+		}
+		if client.chat.isQuitCommand(name) {
+			client.Notify(fmt.Sprintf("%s\n  Leave the chat.\n", name), client.id)
+			return
+		}
+		cmd := lookupCommand(name)
+		if cmd == nil {
+			client.Notify(fmt.Sprintf("No such command: %s\n", name), client.id)
+			return
+		}
+		text := fmt.Sprintf("%s\n  %s\n", cmd.usage, cmd.description)
+		if cmd.oper {
+			text += "  Operators only.\n"
+		}
+		client.Notify(text, client.id)
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("Commands:\n")
+	for _, cmd := range commands {
+		if cmd.oper && !client.oper.Load() {
+			continue
+		}
+		fmt.Fprintf(&b, "  %-38s %s\n", cmd.usage, cmd.summary())
+	}
+	if aliases := client.chat.config.QuitAliases; len(aliases) > 0 {
+		fmt.Fprintf(&b, "  %-38s %s\n", strings.Join(aliases, ", "), "Leave the chat")
+	}
+	b.WriteString("Type /help <command> for details. Commands must start the line: a line beginning with a space is sent as a message.\n")
+	client.Notify(b.String(), client.id)
+}
+
+// isHelpWord reports whether msg is one of the words new users type when
+// looking for help.
+func isHelpWord(msg string) bool {
+	switch strings.ToLower(msg) {
+	case "help", "?", "commands":
+		return true
+	}
+	return false
+}
+
+// command is a slash command clients can send, with the metadata /help
+// shows for it.
+type command struct {
+	name        string                  // Command name, including the slash
+	usage       string                  // Synopsis of the arguments
+	description string                  // What the command does, one or two sentences
+	oper        bool                    // Whether only operators may use it
+	run         func(*Client, []string) // Handler, given the command split by splitArgs
+}
+
+// summary returns the first sentence of the description, for listings.
+func (cmd *command) summary() string {
+	if i := strings.Index(cmd.description, ". "); i >= 0 {
+		return cmd.description[:i]
+	}
+	return strings.TrimSuffix(cmd.description, ".")
+}
+
+// commands holds the registered commands in the order /help lists them.
+var commands []*command
+
+// registerCommand adds a command to the registry.
+func registerCommand(cmd *command) {
+	if lookupCommand(cmd.name) != nil {
+		panic("duplicate command " + cmd.name)
+	}
+	commands = append(commands, cmd)
+}
+
+// lookupCommand returns the registered command with the given name, or
+// nil if there is none.
+func lookupCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// init registers the built-in commands.
+func init() {
+	registerCommand(&command{
+		name:        "/nick",
+		usage:       "/nick <nickname>",
+		description: "Set your nickname.",
+		run:         (*Client).handleNickCommand,
+	})
+	registerCommand(&command{
+		name:        "/whois",
+		usage:       "/whois <nickname|id>",
+		description: "Show who a client is and how long they have been connected.",
+		run:         (*Client).handleWhoisCommand,
+	})
+	registerCommand(&command{
+		name:        "/who",
+		usage:       "/who",
+		description: "List the connected clients.",
+		run:         func(client *Client, parts []string) { client.handleWhoCommand() },
+	})
+	registerCommand(&command{
+		name:        "/ping",
+		usage:       "/ping [token]",
+		description: "Check the connection to the server. The reply echoes the token, so scripts can match it.",
+		run:         (*Client).handlePingCommand,
+	})
+	registerCommand(&command{
+		name:        "/temp",
+		usage:       "/temp <seconds> <message>",
+		description: "Post a message the server does not keep, marked with how long it is meant to last.",
+		run:         (*Client).handleTempCommand,
+	})
+	registerCommand(&command{
+		name:        "/msg",
+		usage:       "/msg <nickname|id>[,...] <message>",
+		description: "Send a private message to a client, or to up to five separated by commas.",
+		run:         (*Client).handleMsgCommand,
+	})
+	registerCommand(&command{
+		name:        "/msgmany",
+		usage:       "/msgmany <nick1,nick2,...> <message>",
+		description: "Send a private message to up to five clients. Each recipient sees who else it was sent to.",
+		run:         (*Client).handleMsgManyCommand,
+	})
+	registerCommand(&command{
+		name:        "/msgs",
+		usage:       "/msgs <nickname|id>",
+		description: "Replay your recent private messages with a client. Only the two of you can see them.",
+		run:         (*Client).handleMsgsCommand,
+	})
+	registerCommand(&command{
+		name:        "/dnd",
+		usage:       "/dnd on|off",
+		description: "Turn do-not-disturb on or off. Mentions and private messages still arrive but don't ring your bell, and senders of private messages are told you are busy.",
+		run:         (*Client).handleDndCommand,
+	})
+	registerCommand(&command{
+		name:        "/subscribe",
+		usage:       "/subscribe <keyword>",
+		description: "Only receive messages containing one of your keywords. Mentions of your nickname always get through.",
+		run:         (*Client).handleSubscribeCommand,
+	})
+	registerCommand(&command{
+		name:        "/unsubscribe",
+		usage:       "/unsubscribe [keyword]",
+		description: "Drop a keyword filter. Without a keyword, drop them all and receive everything again.",
+		run:         (*Client).handleUnsubscribeCommand,
+	})
+	registerCommand(&command{
+		name:        "/oper",
+		usage:       "/oper <password>",
+		description: "Authenticate as an operator.",
+		run:         (*Client).handleOperCommand,
+	})
+	registerCommand(&command{
+		name:        "/help",
+		usage:       "/help [command]",
+		description: "List the commands, or describe one of them.",
+		run:         (*Client).handleHelpCommand,
+	})
+	registerCommand(&command{
+		name:        "/lag",
+		usage:       "/lag <nickname|id>",
+		oper:        true,
+		description: "Show how long ago a client was last written to successfully.",
+		run:         (*Client).handleLagCommand,
+	})
+	registerCommand(&command{
+		name:        "/kickid",
+		usage:       "/kickid <id> [reason]",
+		oper:        true,
+		description: "Disconnect a client given its ID.",
+		run:         func(client *Client, parts []string) { client.handleKickIDCommand(parts, false) },
+	})
+	registerCommand(&command{
+		name:        "/banid",
+		usage:       "/banid <id> [reason]",
+		oper:        true,
+		description: "Ban the address of a client given its ID and disconnect it.",
+		run:         func(client *Client, parts []string) { client.handleKickIDCommand(parts, true) },
+	})
+	registerCommand(&command{
+		name:        "/warn",
+		usage:       "/warn <nickname|id> <reason>",
+		oper:        true,
+		description: "Formally warn a client. Repeated warnings mute and then kick them.",
+		run:         (*Client).handleWarnCommand,
+	})
+	registerCommand(&command{
+		name:        "/warnings",
+		usage:       "/warnings <nickname|id>",
+		oper:        true,
+		description: "Show the recent warnings given to a client, and how many went to others from its address.",
+		run:         (*Client).handleWarningsCommand,
+	})
+	registerCommand(&command{
+		name:        "/limit",
+		usage:       "/limit <nickname|id> rate=N[/duration] bytes=N[/duration] maxlen=N | clear",
+		oper:        true,
+		description: "Override the rate and length limits of a client until it disconnects, or restore the defaults with clear.",
+		run:         (*Client).handleLimitCommand,
+	})
+	registerCommand(&command{
+		name:        "/unfurl",
+		usage:       "/unfurl on|off",
+		oper:        true,
+		description: "Turn posting of link titles on or off.",
+		run:         (*Client).handleUnfurlCommand,
+	})
+	registerCommand(&command{
+		name:        "/stats",
+		usage:       "/stats",
+		oper:        true,
+		description: "Show the server counters.",
+		run:         func(client *Client, parts []string) { client.handleStatsCommand() },
+	})
+}
+
+// handleQuitCommand handles /quit and its configured aliases, which
+// disconnect the client gracefully.
+func (client *Client) handleQuitCommand() {
+	client.Notify("Goodbye!\n", client.id)
+	client.Close(disconnectQuit)
+}
+
+// handleLimitCommand handles the operator /limit command, which overrides
+// the limits of a single client until it disconnects, or restores the
+// server defaults with "clear".
+func (client *Client) handleLimitCommand(parts []string) {
+	usage := "Usage: /limit <nickname|id> rate=N[/duration] bytes=N[/duration] maxlen=N | clear\n"
+	if !client.oper.Load() {
+		client.Notify("Permission denied\n", client.id)
+		return
+	}
+
+	if len(parts) != 2 {
+		client.Notify(usage, client.id)
+		return
+	}
+
+	args := strings.Fields(parts[1])
+	if len(args) < 2 {
+		client.Notify(usage, client.id)
+		return
+	}
+
+	chat := client.chat
+	chat.mu.Lock()
+	target := chat.findClient(args[0])
+	var name string
+	if target != nil {
+		name = target.displayName()
+	}
+	chat.mu.Unlock()
+
+	if target == nil {
+		client.Notify(fmt.Sprintf("No such user: %s\n", args[0]), client.id)
+		return
+	}
+
+	limits := chat.defaultLimits()
+	if !(len(args) == 2 && strings.EqualFold(args[1], "clear")) {
+		var err error
+		limits, err = parseLimits(target.getLimits(), args[1:])
+		if err != nil {
+			client.Notify(fmt.Sprintf("%v\n%s", err, usage), client.id)
+			return
+		}
+		limits.overridden = true
+	}
+
+	target.setLimits(limits)
+	log.Printf("Limits of client %s set to %s by %s", target.id, limits, client.id)
+	client.Notify(fmt.Sprintf("Limits of %s: %s\n", name, limits), client.id)
+}
+
+// handleUnfurlCommand handles the operator /unfurl command, which turns
+// posting of link titles on or off.
+func (client *Client) handleUnfurlCommand(parts []string) {
+	if !client.oper.Load() {
+		client.Notify("Permission denied\n", client.id)
+		return
+	}
+
+	if len(parts) != 2 {
+		client.Notify("Usage: /unfurl on|off\n", client.id)
+		return
+	}
+
+	switch strings.ToLower(strings.TrimSpace(parts[1])) {
+	case "on":
+		client.chat.unfurlEnabled.Store(true)
+		client.Notify("Link titles will be posted\n", client.id)
+	case "off":
+		client.chat.unfurlEnabled.Store(false)
+		client.Notify("Link titles will no longer be posted\n", client.id)
+	default:
+		client.Notify("Usage: /unfurl on|off\n", client.id)
+	}
+}
+
+// handleDndCommand handles the /dnd command, which turns the client's
+// do-not-disturb mode on or off.
+func (client *Client) handleDndCommand(parts []string) {
+	if len(parts) != 2 {
+		client.Notify("Usage: /dnd on|off\n", client.id)
+		return
+	}
+
+	switch strings.ToLower(strings.TrimSpace(parts[1])) {
+	case "on":
+		client.dnd.Store(true)
+		client.Notify("Do-not-disturb is on\n", client.id)
+	case "off":
+		client.dnd.Store(false)
+		client.Notify("Do-not-disturb is off\n", client.id)
+	default:
+		client.Notify("Usage: /dnd on|off\n", client.id)
+	}
+}
+
+// handleSubscribeCommand handles the /subscribe command, which limits the
+// broadcasts a client receives to those containing one of its keywords.
+func (client *Client) handleSubscribeCommand(parts []string) {
+	chat := client.chat
+	if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+		chat.mu.Lock()
+		keywords := strings.Join(client.keywords, ", ")
+		chat.mu.Unlock()
+
+		if keywords == "" {
+			client.Notify("Usage: /subscribe <keyword>\n", client.id)
+		} else {
+			client.Notify(fmt.Sprintf("Subscribed to: %s\n", keywords), client.id)
+		}
+		return
+	}
+
+	keyword := strings.ToLower(strings.TrimSpace(parts[1]))
+
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+	for _, kw := range client.keywords {
+		if kw == keyword {
+			client.Notify(fmt.Sprintf("Already subscribed to %s\n", keyword), client.id)
+			return
+		}
+	}
+
+	// Each keyword is matched against every broadcast, so cap them
+	if limit := chat.config.MaxSubscriptions; limit > 0 && len(client.keywords) >= limit {
+		client.Notify(fmt.Sprintf("You cannot subscribe to more than %d keywords\n", limit), client.id)
+		return
+	}
+	client.keywords = append(client.keywords, keyword)
+	client.Notify(fmt.Sprintf("Subscribed to %s\n", keyword), client.id)
+}
+
+// handleUnsubscribeCommand handles the /unsubscribe command. Without an
+// argument it drops every keyword and the client receives everything again.
+func (client *Client) handleUnsubscribeCommand(parts []string) {
+	chat := client.chat
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+
+	if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+		client.keywords = nil
+		client.Notify("Unsubscribed from all keywords\n", client.id)
+		return
+	}
+
+	keyword := strings.ToLower(strings.TrimSpace(parts[1]))
+	for i, kw := range client.keywords {
+		if kw == keyword {
+			client.keywords = append(client.keywords[:i], client.keywords[i+1:]...)
+			client.Notify(fmt.Sprintf("Unsubscribed from %s\n", keyword), client.id)
+			return
+		}
+	}
+	client.Notify(fmt.Sprintf("Not subscribed to %s\n", keyword), client.id)
+}
+
+// New creates a chat server with the given settings, checking them
+// first. Callers usually start from DefaultConfig and change what they
+// need.
+func New(config Config) (*ChatSystem, error) {
+	return newChatSystem(config, realClock{})
+}
+
+// newChatSystem creates a chat server that reads the time from clock.
+func newChatSystem(config Config, clock Clock) (*ChatSystem, error) {
+	if config.IdentityPolicy != policyAnonymousOK && config.IdentityPolicy != policyNickRequired {
+		return nil, fmt.Errorf("unsupported identity policy %q", config.IdentityPolicy)
+	}
+	if config.CooldownPolicy != cooldownReject && config.CooldownPolicy != cooldownQueue {
+		return nil, fmt.Errorf("unsupported cooldown policy %q", config.CooldownPolicy)
+	}
+	if config.LeaveScope != leaveScopeServer && config.LeaveScope != leaveScopeNone {
+		return nil, fmt.Errorf("unsupported leave notice scope %q", config.LeaveScope)
+	}
+
+	config.QuitAliases = normalizeCommands(config.QuitAliases)
+	for _, alias := range config.QuitAliases {
+		if lookupCommand(alias) != nil {
+			return nil, fmt.Errorf("quit alias %s is already a command", alias)
+		}
+	}
+	chat := &ChatSystem{config: config, clock: clock, unfurler: newUnfurler(clock), tasks: newTasks()}
+	if config.QuietHours != "" {
+		quiet, err := parseQuietHours(config.QuietHours, config.QuietZone, config.QuietPolicy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quiet hours: %w", err)
+		}
+		chat.quietHours = quiet
+	}
+	if config.PeakFile != "" {
+		if err := chat.loadPeak(); err != nil {
+			return nil, fmt.Errorf("invalid peak file: %w", err)
+		}
+	}
+	chat.unfurlEnabled.Store(config.Unfurl)
+	if config.UsageStats {
+		chat.usage = newUsageStats(clock)
+	}
+	if config.LockStats {
+		chat.mu.enable()
+	}
+	patterns, err := parseSecretPatterns(config.MaskSecrets)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret patterns: %w", err)
+	}
+	chat.secretPatterns = patterns
+
+	maxHandlers := config.MaxHandlers
+	if maxHandlers <= 0 {
+		maxHandlers = config.MaxClients
+	}
+	chat.handlers = make(chan struct{}, maxHandlers)
+	return chat, nil
+}
+
+// Run listens on the configured port and serves clients with Serve until
+// ctx is cancelled.
+func (chat *ChatSystem) Run(ctx context.Context) error {
+	l, err := net.Listen("tcp", ":"+chat.config.Port)
+	if err != nil {
+		return err
+	}
+	return chat.Serve(ctx, l)
+}
+
+// Serve accepts clients on l and serves them until ctx is cancelled, then
+// closes l and shuts down. It is for programs that open the listener
+// themselves; Serve must be called only once per ChatSystem, and only if
+// Run is not. The server's background work runs as components of the
+// lifecycle manager, so shutdown happens in the reverse of the start
+// order: the listener is closed and the accept loop returns, every client
+// is told about the shutdown and disconnected, and the remaining
+// background tasks are cancelled and waited for before Serve returns.
+func (chat *ChatSystem) Serve(ctx context.Context, l net.Listener) error {
+	chat.lifecycle.register("tasks", nil, chat.tasks.stop)
+	chat.lifecycle.register("clients", nil, func(context.Context) error {
+		chat.shutdown()
+		return nil
+	})
+
+	acceptDone := make(chan struct{})
+	chat.lifecycle.register("listener", func(context.Context) error {
+		chat.serversock = l
+		go func() {
+			defer close(acceptDone)
+			chat.acceptLoop(ctx)
+		}()
+		return nil
+	}, func(ctx context.Context) error {
+		chat.serversock.Close()
+		select {
+		case <-acceptDone:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+
+	if err := chat.lifecycle.start(ctx); err != nil {
+		return err
+	}
+
+	<-ctx.Done()
+	log.Print("Server shutting down...")
+
+	chat.lifecycle.stop()
+	return nil
+}
+
+// lifecycle starts the server's background components in order and stops
+// them in reverse order. Every component that runs a goroutine for the
+// lifetime of the server registers with it, so start and stop wiring lives
+// in one place.
+type lifecycle struct {
+	components []component // Registered components, in start order
+	started    int         // Number of components started, from the front
+}
+
+// component is a unit of background work managed by the lifecycle. Either
+// function may be nil.
+type component struct {
+	name  string
+	start func(ctx context.Context) error // Starts the work and returns; must not block
+	stop  func(ctx context.Context) error // Stops the work, giving up when ctx is done
+}
+
+// register adds a component to be started after those already registered.
+func (lc *lifecycle) register(name string, start, stop func(context.Context) error) {
+	lc.components = append(lc.components, component{name: name, start: start, stop: stop})
+}
+
+// start starts the components in registration order. If one fails to
+// start, those already started are stopped again and the error returned.
+func (lc *lifecycle) start(ctx context.Context) error {
+	for _, c := range lc.components[lc.started:] {
+		if c.start != nil {
+			if err := c.start(ctx); err != nil {
+				lc.stop()
+				return fmt.Errorf("starting %s: %w", c.name, err)
+			}
+		}
+		lc.started++
+	}
+	return nil
+}
+
+// stop stops the started components in reverse order, giving each one
+// componentStopTimeout. A component that fails or times out is logged and
+// the rest are still stopped.
+func (lc *lifecycle) stop() {
+	for ; lc.started > 0; lc.started-- {
+		c := lc.components[lc.started-1]
+		if c.stop == nil {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), componentStopTimeout)
+		done := make(chan error, 1)
+		go func() { done <- c.stop(ctx) }()
+
+		var err error
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		cancel()
+		if err != nil {
+			log.Printf("Error stopping %s: %v", c.name, err)
+		}
+	}
+}
+
+// tasks runs short-lived background work, such as link title fetches and
+// the release of messages held during the join cooldown, so that shutdown
+// can cancel it and wait for it to end.
+type tasks struct {
+	ctx     context.Context    // Cancelled when the tasks are stopped
+	cancel  context.CancelFunc // Cancels ctx
+	mu      sync.Mutex         // Mutex to protect stopped and the adds to wg
+	stopped bool               // Set by stop; no new tasks run after it
+	wg      sync.WaitGroup     // Running tasks
+}
+
+// newTasks creates an empty set of tasks.
+func newTasks() *tasks {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &tasks{ctx: ctx, cancel: cancel}
+}
+
+// spawn runs task on its own goroutine with a context that is cancelled
+// at shutdown, and reports whether it did: nothing runs once the tasks
+// are stopped.
+func (t *tasks) spawn(task func(ctx context.Context)) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		return false
+	}
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		task(t.ctx)
+	}()
+	return true
+}
+
+// stop cancels the running tasks and waits for them to return, giving up
+// when ctx is done.
+func (t *tasks) stop(ctx context.Context) error {
+	t.mu.Lock()
+	t.stopped = true
+	t.mu.Unlock()
+	t.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// acceptLoop accepts incoming connections until the listener is closed.
+// Pauses after failed accepts end early when ctx is cancelled, and the
+// loop then returns.
+func (chat *ChatSystem) acceptLoop(ctx context.Context) {
+	var backoff time.Duration
+	for {
+		conn, err := chat.serversock.Accept()
+		if err != nil {
+			// The listener was closed, the server is shutting down
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			// Running out of file descriptors won't resolve quickly,
+			// so pause for longer and let the operators know
+			if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+				chat.fdExhaustions.Add(1)
+				log.Printf("Error accepting connection: %v; pausing for %v", err, fdExhaustedPause)
+				chat.notifyOpers("Server is out of file descriptors, new connections are paused\n")
+				if !chat.sleep(ctx, fdExhaustedPause) {
+					return
+				}
+				continue
+			}
+
+			// Back off exponentially on temporary errors instead of spinning
+			if backoff == 0 {
+				backoff = minAcceptBackoff
+			} else {
+				backoff = min(backoff*2, maxAcceptBackoff)
+			}
+			log.Printf("Error accepting connection: %v; retrying in %v", err, backoff)
+			if !chat.sleep(ctx, backoff) {
+				return
+			}
+			continue
+		}
+
+		backoff = 0
+		chat.acceptClient(conn)
+	}
+}
+
+// newClient creates a client for a connection, with a new ID and the
+// default limits. Nothing runs for it until it is started.
+func (chat *ChatSystem) newClient(conn net.Conn) *Client {
+	reads := &readCounter{r: conn}
+	client := &Client{
+		id:       chat.generateClientID(),
+		conn:     conn,
+		chat:     chat,
+		reads:    reads,
+		reader:   bufio.NewReader(reads),
+		joined:   chat.clock.Now(),
+		newcomer: true,
+		outbox:   newOutbox(&chat.queuedBytes),
+		done:     make(chan struct{}),
+	}
+	client.setLimits(chat.defaultLimits())
+	return client
+}
+
+// acceptClient sets up a newly accepted connection as a chat client.
+func (chat *ChatSystem) acceptClient(conn net.Conn) {
+	if host := remoteHost(conn); chat.isBanned(host) {
+		conn.Write([]byte(bannedMsg))
+		conn.Close()
+		log.Printf("Refused connection from banned address %s", host)
+		return
+	}
+
+	client := chat.newClient(conn)
+
+	count := chat.clientCount()
+	if count >= chat.config.MaxClients {
+		conn.Write([]byte(fullMsg + chat.reconnectHint()))
+		conn.Close()
+		log.Printf("Rejected connection from %s: server is full", remoteHost(conn))
+		return
+	}
+
+	// Slots past the non-reserved capacity are kept for operators
+	client.reserved = count >= chat.config.MaxClients-chat.config.ReservedSlots
+
+	// Bound the number of handler goroutines even when connections arrive
+	// faster than the client count can catch up
+	wait := chat.clock.NewTimer(handlerWait)
+	defer wait.Stop()
+	select {
+	case chat.handlers <- struct{}{}:
+	case <-wait.C():
+		conn.Write([]byte(busyMsg + chat.reconnectHint()))
+		conn.Close()
+		log.Printf("Rejected connection from %s: too many client handlers", remoteHost(conn))
+		return
+	}
+
+	// From here on shutdown closes the client, even if it never joins
+	if !chat.trackClient(client) {
+		<-chat.handlers
+		conn.Write([]byte(shutdownMsg))
+		conn.Close()
+		return
+	}
+
+	log.Printf("Connected client clientid=%d", client.id)
+	go client.writeLoop()
+	go func() {
+		defer func() { <-chat.handlers }()
+		client.listen()
+	}()
+}
+
+// trackClient records a newly accepted client, so shutdown can close it
+// before it has joined, and reports whether it did: nothing is tracked
+// once shutdown has started.
+func (chat *ChatSystem) trackClient(client *Client) bool {
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+	if chat.closing {
+		return false
+	}
+	if chat.clients == nil {
+		chat.clients = make(map[*Client]bool)
+	}
+	chat.clients[client] = true
+	return true
+}
+
+// shutdown tells every client that the server is going away and closes
+// their connections, then waits for the client handlers to finish. This
+// includes clients that have not joined yet, such as those in the
+// operator handshake. Clients are detached from the observers list first:
+// broadcasts queue with chat.mu held, so once the list is emptied no
+// broadcast can queue a message for a client being closed, and no client
+// can join afterwards. Each client's writer flushes the notice before
+// closing the connection, within closeFlushTimeout, so a stalled client
+// doesn't hold up the rest.
+func (chat *ChatSystem) shutdown() {
+	chat.mu.Lock()
+	chat.closing = true
+	clients := make([]*Client, 0, len(chat.clients))
+	for client := range chat.clients {
+		clients = append(clients, client)
+		chat.removeObserverLocked(client)
+	}
+	chat.mu.Unlock()
+
+	notice := shutdownMsg + chat.reconnectHint()
+	for _, client := range clients {
+		client.notice(notice)
+		client.Close(disconnectShutdown)
+	}
+
+	chat.drainHandlers(shutdownTimeout)
+}
+
+// drainHandlers waits until every client handler has returned, or until
+// the timeout passes. It takes all the handler slots, so nothing can be
+// running once it has them.
+func (chat *ChatSystem) drainHandlers(wait time.Duration) {
+	timeout := chat.clock.NewTimer(wait)
+	defer timeout.Stop()
+	for taken := 0; taken < cap(chat.handlers); taken++ {
+		select {
+		case chat.handlers <- struct{}{}:
+		case <-timeout.C():
+			log.Printf("%d client handlers still running at shutdown", cap(chat.handlers)-taken)
+			return
+		}
+	}
+}
+
+// formatDuration renders a duration for people: sub-second durations in
+// milliseconds, and longer ones as their two most significant units, e.g.
+// "2d 4h" or "3m 12s" rather than "52h13m9s".
+func formatDuration(d time.Duration) string {
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+
+	units := []struct {
+		size time.Duration
+		name string
+	}{
+		{24 * time.Hour, "d"},
+		{time.Hour, "h"},
+		{time.Minute, "m"},
+		{time.Second, "s"},
+	}
+
+	var parts []string
+	for _, unit := range units {
+		if n := d / unit.size; n > 0 || len(parts) > 0 {
+			parts = append(parts, fmt.Sprintf("%d%s", n, unit.name))
+			d -= n * unit.size
+		}
+		if len(parts) == 2 {
+			break
+		}
+	}
+	if len(parts) == 2 && strings.HasPrefix(parts[1], "0") {
+		parts = parts[:1]
+	}
+	return strings.Join(parts, " ")
+}
+
+// mentions reports whether a message, given in lower case, mentions nick
+// as "@nick". The mention must end the message or be followed by a
+// character that cannot continue a name, so "@al" is not found in
+// "@alice".
+func mentions(lower, nick string) bool {
+	target := "@" + strings.ToLower(nick)
+	for from := 0; ; {
+		i := strings.Index(lower[from:], target)
+		if i < 0 {
+			return false
+		}
+		end := from + i + len(target)
+		next, _ := utf8.DecodeRuneInString(lower[end:])
+		if end == len(lower) || !(unicode.IsLetter(next) || unicode.IsDigit(next) || next == '_' || next == '-') {
+			return true
+		}
+		from += i + 1
+	}
+}
+
+// splitArgs splits a line into its first word and the rest of the line,
+// like strings.SplitN(s, " ", 2) but treating any run of whitespace
+// (tabs included) as the separator. It returns a single element when
+// there is nothing after the first word.
+func splitArgs(s string) []string {
+	i := strings.IndexFunc(s, unicode.IsSpace)
+	if i < 0 {
+		return []string{s}
+	}
+	rest := strings.TrimLeftFunc(s[i:], unicode.IsSpace)
+	if rest == "" {
+		return []string{s[:i]}
+	}
+	return []string{s[:i], rest}
+}
+
+// parseCommandList parses a comma-separated list of command names,
+// adding the leading slash where it is missing.
+func parseCommandList(s string) []string {
+	return normalizeCommands(strings.Split(s, ","))
+}
+
+// normalizeCommands lowercases command names and adds the leading slash
+// where it is missing, dropping empty names.
+func normalizeCommands(names []string) []string {
+	var commands []string
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if !strings.HasPrefix(name, "/") {
+			name = "/" + name
+		}
+		commands = append(commands, name)
+	}
+	return commands
+}
+
+// remoteHost returns the host part of a connection's remote address.
+func remoteHost(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// generateClientID generates a unique client ID for a new client.
+// IDs come from a counter and are never reused while the process runs.
+func (chat *ChatSystem) generateClientID() ClientID {
+	return ClientID(chat.lastClientID.Add(1))
+}
+
+// clientLimits holds the limits applied to the lines a client sends.
+// Every client starts with the server defaults; operators can override
+// them for a single client with /limit. A zero value means unlimited.
+type clientLimits struct {
+	msgRate    rate // Lines per period
+	byteRate   rate // Bytes per period
+	maxLength  int  // Longest accepted message, in bytes
+	overridden bool // Whether an operator set these limits
+}
+
+// defaultLimits returns the limits configured for every client.
+func (chat *ChatSystem) defaultLimits() clientLimits {
+	return clientLimits{
+		msgRate:   rate{count: chat.config.MsgRate, per: time.Second},
+		byteRate:  rate{count: float64(chat.config.ByteRate), per: time.Second},
+		maxLength: chat.config.MaxLength,
+	}
+}
+
+// String renders the limits in the form accepted by /limit.
+func (limits clientLimits) String() string {
+	maxLength := "unlimited"
+	if limits.maxLength > 0 {
+		maxLength = strconv.Itoa(limits.maxLength)
+	}
+	return fmt.Sprintf("rate=%s bytes=%s maxlen=%s", limits.msgRate, limits.byteRate, maxLength)
+}
+
+// parseLimits applies settings such as "rate=30/10s maxlen=2048" on top
+// of limits. Rates are a count per second, or a count per duration.
+func parseLimits(limits clientLimits, settings []string) (clientLimits, error) {
+	for _, setting := range settings {
+		key, value, ok := strings.Cut(setting, "=")
+		if !ok {
+			return limits, fmt.Errorf("invalid setting %q", setting)
+		}
+
+		var err error
+		switch strings.ToLower(key) {
+		case "rate":
+			limits.msgRate, err = parseRate(value)
+		case "bytes":
+			limits.byteRate, err = parseRate(value)
+		case "maxlen":
+			limits.maxLength, err = strconv.Atoi(value)
+			if err == nil && limits.maxLength < 0 {
+				err = fmt.Errorf("negative length")
+			}
+		default:
+			return limits, fmt.Errorf("unknown limit %q", key)
+		}
+		if err != nil {
+			return limits, fmt.Errorf("invalid %s value %q", key, value)
+		}
+	}
+	return limits, nil
+}
+
+// rate is a limit of count tokens per period. The count is also the burst
+// a client may send at once after being idle, so "30/10s" allows thirty
+// lines in a row where "3" allows three. The zero value is unlimited.
+type rate struct {
+	count float64       // Tokens per period
+	per   time.Duration // Length of the period
+}
+
+// String renders the rate in the form accepted by parseRate.
+func (r rate) String() string {
+	if r.count <= 0 {
+		return "unlimited"
+	}
+	count := strconv.FormatFloat(r.count, 'f', -1, 64)
+	if r.per == time.Second {
+		return count + "/s"
+	}
+	return count + "/" + r.per.String()
+}
+
+// parseRate parses a rate such as "5" (per second) or "30/10s".
+func parseRate(s string) (rate, error) {
+	count, per, hasPer := strings.Cut(s, "/")
+	n, err := strconv.ParseFloat(count, 64)
+	if err != nil || n < 0 {
+		return rate{}, fmt.Errorf("invalid rate %q", s)
+	}
+	if !hasPer || per == "s" {
+		return rate{count: n, per: time.Second}, nil
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return rate{}, fmt.Errorf("invalid rate %q", s)
+	}
+	return rate{count: n, per: d}, nil
+}
+
+// Quiet hours policies, applied to everyone but operators during the window
+const (
+	quietSlow     = "slow"     // One message per quietSlowInterval per client
+	quietReadOnly = "readonly" // Only operators may post
+)
+
+// quietHours is a daily time window during which a restricted posting
+// policy applies server-wide. A nil *quietHours is never active.
+type quietHours struct {
+	start  time.Duration  // Start of the window, as an offset from midnight
+	end    time.Duration  // End of the window; before start if it spans midnight
+	loc    *time.Location // Time zone the window is expressed in
+	policy string         // One of the quiet hours policy constants
+}
+
+// parseQuietHours parses a window such as "22:00-07:00" in the named time
+// zone ("" or "Local" for the server's zone).
+func parseQuietHours(window, zone, policy string) (*quietHours, error) {
+	if policy != quietSlow && policy != quietReadOnly {
+		return nil, fmt.Errorf("unknown quiet hours policy %q", policy)
+	}
+
+	from, to, ok := strings.Cut(window, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid quiet hours window %q", window)
+	}
+	start, err := time.Parse("15:04", strings.TrimSpace(from))
+	if err != nil {
+		return nil, fmt.Errorf("invalid quiet hours start %q", from)
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(to))
+	if err != nil {
+		return nil, fmt.Errorf("invalid quiet hours end %q", to)
+	}
+
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return nil, err
+	}
+
+	return &quietHours{start: sinceMidnight(start), end: sinceMidnight(end), loc: loc, policy: policy}, nil
+}
+
+// active reports whether now falls inside the quiet hours window.
+func (q *quietHours) active(now time.Time) bool {
+	if q == nil {
+		return false
+	}
+	offset := sinceMidnight(now.In(q.loc))
+	if q.start <= q.end {
+		return offset >= q.start && offset < q.end
+	}
+	return offset >= q.start || offset < q.end
+}
+
+// sinceMidnight returns the time of day of t as an offset from midnight.
+func sinceMidnight(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+}
+
+// timedMutex is a sync.Mutex that can measure how long Lock waits, to show
+// how contended a lock is. Measuring is off until enable is called, and
+// then costs two clock reads and a few atomic adds per Lock. Wait times
+// are real durations, so they are measured with the time package rather
+// than the chat's Clock.
+type timedMutex struct {
+	sync.Mutex
+	enabled      atomic.Bool  // Whether Lock measures its wait
+	since        atomic.Int64 // When measuring started, in Unix nanoseconds
+	acquisitions atomic.Int64 // Locks taken while measuring
+	waited       atomic.Int64 // Total time spent waiting in Lock, in nanoseconds
+	maxWait      atomic.Int64 // Longest single wait in Lock, in nanoseconds
+}
+
+// enable starts measuring lock waits.
+func (m *timedMutex) enable() {
+	m.since.Store(time.Now().UnixNano())
+	m.enabled.Store(true)
+}
+
+// Lock locks m, recording the wait when measuring is enabled.
+func (m *timedMutex) Lock() {
+	if !m.enabled.Load() {
+		m.Mutex.Lock()
+		return
+	}
+
+	start := time.Now()
+	m.Mutex.Lock()
+	wait := int64(time.Since(start))
+	m.acquisitions.Add(1)
+	m.waited.Add(wait)
+	for {
+		longest := m.maxWait.Load()
+		if wait <= longest || m.maxWait.CompareAndSwap(longest, wait) {
+			break
+		}
+	}
+}
+
+// report writes the lock wait counters to w under the given name. It
+// writes nothing when measuring is disabled.
+func (m *timedMutex) report(w io.Writer, name string) {
+	if !m.enabled.Load() {
+		return
+	}
+	acquisitions := m.acquisitions.Load()
+	elapsed := time.Since(time.Unix(0, m.since.Load())).Seconds()
+	fmt.Fprintf(w, "%s acquisitions: %d (%.1f/s)\n", name, acquisitions, float64(acquisitions)/max(elapsed, 1))
+	fmt.Fprintf(w, "%s wait: %v total, %v max\n", name, time.Duration(m.waited.Load()), time.Duration(m.maxWait.Load()))
+}
+
+// readCounter counts the reads made on a client connection and the bytes
+// they returned. The counts are atomic so /whois can read them while the
+// client's goroutine reads.
+type readCounter struct {
+	r     io.Reader
+	reads atomic.Int64 // Reads that returned data
+	bytes atomic.Int64 // Bytes returned
+}
+
+// Read reads from the underlying reader, counting the read.
+func (rc *readCounter) Read(p []byte) (int, error) {
+	n, err := rc.r.Read(p)
+	if n > 0 {
+		rc.reads.Add(1)
+		rc.bytes.Add(int64(n))
+	}
+	return n, err
+}
+
+// rateLimiter is a token bucket refilled at a steady pace and holding one
+// period's worth of tokens, or at least one token. A nil limiter allows
+// everything.
+type rateLimiter struct {
+	rate   float64   // Tokens added per second
+	burst  float64   // Tokens the bucket holds when full
+	tokens float64   // Tokens currently available
+	last   time.Time // Time tokens were last added
+}
+
+// newRateLimiter creates a limiter for r, or returns nil when r is
+// unlimited. The bucket starts full.
+func newRateLimiter(r rate) *rateLimiter {
+	if r.count <= 0 || r.per <= 0 {
+		return nil
+	}
+	burst := max(r.count, 1)
+	return &rateLimiter{rate: r.count / r.per.Seconds(), burst: burst, tokens: burst}
+}
+
+// allow takes n tokens from the bucket and reports whether there were
+// enough of them.
+func (l *rateLimiter) allow(n float64, now time.Time) bool {
+	if !l.has(n, now) {
+		return false
+	}
+	l.take(n)
+	return true
+}
+
+// has adds the tokens earned since the last call and reports whether n of
+// them are available, without taking them. A request larger than the
+// bucket lets tokens build up to its size, so it passes after waiting
+// rather than never.
+func (l *rateLimiter) has(n float64, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+
+	if !l.last.IsZero() {
+		l.tokens = min(max(l.burst, n), l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+	return l.tokens >= n
+}
+
+// take removes n tokens from the bucket, after has has reported them
+// available.
+func (l *rateLimiter) take(n float64) {
+	if l != nil {
+		l.tokens -= n
+	}
+}
+
+// secretPattern detects one kind of secret pasted into the chat. When re
+// has a capture group, only the group is masked and the rest of the match
+// is context.
+type secretPattern struct {
+	name     string
+	re       *regexp.Regexp
+	check    func(secret string) bool // Further test of a secret; nil accepts all
+	skipURLs bool                     // Whether matches inside a URL are left alone
+}
+
+// secretContext is what must come before a hex or base64 secret for it to
+// be masked, such as "key=", "token: " or "Bearer ". Long hex strings and
+// mixed-case words are too common on their own: commit hashes, checksums,
+// paths and identifiers would all be masked.
+const secretContext = `(?i:(?:key|token|secret|passw(?:or)?d|pwd|auth)["']?\s*[:=]\s*["']?|bearer\s+)`
+
+// secretPatterns are the secrets that can be masked, selected by name with
+// -mask-secrets. The aws, slack and pem formats carry their own prefix;
+// hex and base64 are only masked after a secretContext.
+var secretPatterns = []secretPattern{
+	{name: "aws", re: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{name: "slack", re: regexp.MustCompile(`\bxox[abposr]-[0-9A-Za-z-]{10,}`)},
+	{name: "pem", re: regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`)},
+	{name: "hex", re: regexp.MustCompile(secretContext + `([0-9a-fA-F]{32,})\b`)},
+	{name: "base64", re: regexp.MustCompile(secretContext + `([A-Za-z0-9+/_-]{40,}={0,2})`), check: looksRandom, skipURLs: true},
+}
+
+// parseSecretPatterns returns the secret patterns named in a
+// comma-separated list.
+func parseSecretPatterns(list string) ([]secretPattern, error) {
+	var enabled []secretPattern
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name == "" {
+			continue
+		}
+		i := slices.IndexFunc(secretPatterns, func(p secretPattern) bool { return p.name == name })
+		if i < 0 {
+			return nil, fmt.Errorf("unknown secret pattern %q", name)
+		}
+		enabled = append(enabled, secretPatterns[i])
+	}
+	return enabled, nil
+}
+
+// maskSecrets replaces the secrets found in msg with asterisks and reports
+// how many were masked.
+func (chat *ChatSystem) maskSecrets(msg string) (string, int) {
+	masked := 0
+	for _, p := range chat.secretPatterns {
+		var urls [][]int
+		if p.skipURLs {
+			urls = urlPattern.FindAllStringIndex(msg, -1)
+		}
+		var b strings.Builder
+		last := 0
+		for _, loc := range p.re.FindAllStringSubmatchIndex(msg, -1) {
+			if len(loc) > 2 {
+				loc = loc[2:4]
+			}
+			secret := msg[loc[0]:loc[1]]
+			if p.check != nil && !p.check(secret) {
+				continue
+			}
+			if slices.ContainsFunc(urls, func(url []int) bool { return loc[0] < url[1] && url[0] < loc[1] }) {
+				continue
+			}
+			b.WriteString(msg[last:loc[0]])
+			b.WriteString(strings.Repeat("*", utf8.RuneCountInString(secret)))
+			last = loc[1]
+			masked++
+		}
+		if last > 0 {
+			b.WriteString(msg[last:])
+			msg = b.String()
+		}
+	}
+	if masked > 0 {
+		chat.maskedSecrets.Add(int64(masked))
+	}
+	return msg, masked
+}
+
+// looksRandom reports whether s mixes upper case letters, lower case
+// letters and digits the way encoded keys do. Words, even run together
+// into identifiers or separated by "/" and "_" into paths, switch between
+// those classes of characters every few letters; random characters switch
+// at almost every one. The characters in between, such as "/", "_" and
+// "-", separate runs but are not counted.
+func looksRandom(s string) bool {
+	if !strings.ContainsFunc(s, unicode.IsUpper) || !strings.ContainsFunc(s, unicode.IsLower) || !strings.ContainsFunc(s, unicode.IsDigit) {
+		return false
+	}
+	class := func(r rune) int {
+		switch {
+		case unicode.IsUpper(r):
+			return 1
+		case unicode.IsLower(r):
+			return 2
+		case unicode.IsDigit(r):
+			return 3
+		}
+		return 0
+	}
+	letters, runs, prev := 0, 0, 0
+	for _, r := range s {
+		c := class(r)
+		if c != 0 {
+			letters++
+			if c != prev {
+				runs++
+			}
+		}
+		prev = c
+	}
+	return float64(letters)/float64(runs) < maxRandomRun
+}
+
+// usageStats counts how often each command is used and how many distinct
+// nicknames are taken per day, to see which features people rely on. All
+// methods are no-ops on a nil receiver, which is how counting is disabled.
+type usageStats struct {
+	mu       sync.Mutex
+	clock    Clock           // Clock deciding which day it is
+	commands map[string]int  // Invocations per command name
+	nickDay  string          // Day the nickname set below belongs to
+	nicks    map[string]bool // Distinct nicknames taken on nickDay
+}
+
+// newUsageStats creates an empty set of usage counters.
+func newUsageStats(clock Clock) *usageStats {
+	return &usageStats{
+		clock:    clock,
+		commands: make(map[string]int),
+		nicks:    make(map[string]bool),
+	}
+}
+
+// countCommand counts one use of a command. Past a fixed number of
+// distinct names, further unknown commands are counted together so
+// clients cannot grow the map without bound.
+func (u *usageStats) countCommand(command string) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.commands[command]; !ok && len(u.commands) >= maxUsageCommands {
+		command = "other"
+	}
+	u.commands[command]++
+}
+
+// countNick records a nickname being taken today.
+func (u *usageStats) countNick(nick string) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if today := u.clock.Now().Format(time.DateOnly); today != u.nickDay {
+		u.nickDay = today
+		u.nicks = make(map[string]bool)
+	}
+	u.nicks[strings.ToLower(nick)] = true
+}
+
+// report writes the usage counters to w, sorted by command name.
+func (u *usageStats) report(w io.Writer) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	names := make([]string, 0, len(u.commands))
+	for name := range u.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "Command %s: %d\n", name, u.commands[name])
+	}
+
+	unique := 0
+	if u.nickDay == u.clock.Now().Format(time.DateOnly) {
+		unique = len(u.nicks)
+	}
+	fmt.Fprintf(w, "Unique nicknames today: %d\n", unique)
+}
+
+// unfurler fetches the titles of links posted in the chat. Fetches are
+// strictly bounded and never reach private addresses, and results are
+// cached so a link pasted repeatedly is fetched only once.
+type unfurler struct {
+	client   *http.Client
+	clock    Clock                  // Clock the cache entries expire by
+	mu       sync.Mutex             // Mutex to protect cache and fetching
+	cache    map[string]unfurlEntry // Recent results keyed by URL
+	fetching map[string]bool        // Links being fetched right now
+}
+
+// unfurlEntry is a cached link title. An empty title records a failure.
+type unfurlEntry struct {
+	title   string
+	expires time.Time
+}
+
+var (
+	urlPattern   = regexp.MustCompile(`https?://[^\s<>"]+`)
+	titlePattern = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+)
+
+// newUnfurler creates an unfurler whose HTTP client refuses to connect to
+// loopback, private and link-local addresses, including after redirects.
+func newUnfurler(clock Clock) *unfurler {
+	dialer := &net.Dialer{
+		Timeout: unfurlTimeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+				ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+				return fmt.Errorf("refusing to connect to %s", address)
+			}
+			return nil
+		},
+	}
+
+	return &unfurler{
+		client: &http.Client{
+			Timeout:   unfurlTimeout,
+			Transport: &http.Transport{Proxy: nil, DialContext: dialer.DialContext},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) > unfurlMaxRedirects {
+					return http.ErrUseLastResponse
+				}
+				return nil
+			},
+		},
+		clock:    clock,
+		cache:    make(map[string]unfurlEntry),
+		fetching: make(map[string]bool),
+	}
+}
+
+// unfurl finds the first link in msg and broadcasts its page title. A
+// title that is not cached is fetched in the background, unless the link
+// is already being fetched or too many fetches are running, in which case
+// the link is skipped. Failures are silent.
+func (u *unfurler) unfurl(msg string, chat *ChatSystem) {
+	link := urlPattern.FindString(msg)
+	if link == "" {
+		return
+	}
+
+	if title, ok := u.cached(link); ok {
+		announceTitle(chat, link, title)
+		return
+	}
+	if !u.startFetch(link) {
+		return
+	}
+	spawned := chat.tasks.spawn(func(ctx context.Context) {
+		title := u.fetchTitle(ctx, link)
+		u.store(link, title)
+		announceTitle(chat, link, title)
+	})
+	if !spawned {
+		// The server is shutting down; end the fetch that never started
+		u.store(link, "")
+	}
+}
+
+// announceTitle broadcasts the title of link, if it has one.
+func announceTitle(chat *ChatSystem, link, title string) {
+	if title == "" {
+		return
+	}
+	host := link
+	if parsed, err := url.Parse(link); err == nil {
+		host = parsed.Hostname()
+	}
+	chat.broadcast(fmt.Sprintf("↪ %s — %s\n", title, host), serverSender)
+}
+
+// startFetch marks link as being fetched and reports whether the caller
+// should fetch it: not when it is already in flight or when
+// unfurlMaxFetches fetches are running.
+func (u *unfurler) startFetch(link string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.fetching[link] || len(u.fetching) >= unfurlMaxFetches {
+		return false
+	}
+	u.fetching[link] = true
+	return true
+}
+
+// cached returns the cached title of link, if any.
+func (u *unfurler) cached(link string) (string, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	entry, ok := u.cache[link]
+	if !ok || u.clock.Now().After(entry.expires) {
+		return "", false
+	}
+	return entry.title, true
+}
+
+// store caches the title of link, pruning expired entries, and ends its
+// fetch.
+func (u *unfurler) store(link, title string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.fetching, link)
+	now := u.clock.Now()
+	for key, entry := range u.cache {
+		if now.After(entry.expires) {
+			delete(u.cache, key)
+		}
+	}
+	u.cache[link] = unfurlEntry{title: title, expires: now.Add(unfurlCacheTTL)}
+}
+
+// fetchTitle fetches link and extracts its HTML title, returning an empty
+// string on any failure, including ctx being cancelled.
+func (u *unfurler) fetchTitle(ctx context.Context, link string) string {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return ""
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Content-Type"), "text/html") {
+		return ""
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, unfurlMaxBody))
+	if err != nil {
+		return ""
+	}
+	return extractTitle(body)
+}
+
+// extractTitle returns the title of an HTML page, made safe to post:
+// control and other non-printable characters, which could clear a
+// terminal or reorder the line, become spaces, whitespace is collapsed,
+// and long titles are cut to unfurlMaxTitle runes.
+func extractTitle(page []byte) string {
+	match := titlePattern.FindSubmatch(page)
+	if match == nil {
+		return ""
+	}
+	title := strings.Map(func(r rune) rune {
+		if !unicode.IsPrint(r) {
+			return ' '
+		}
+		return r
+	}, html.UnescapeString(string(match[1])))
+	title = strings.Join(strings.Fields(title), " ")
+	if runes := []rune(title); len(runes) > unfurlMaxTitle {
+		title = string(runes[:unfurlMaxTitle-1]) + "…"
+	}
+	return title
+}
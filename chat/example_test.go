@@ -0,0 +1,120 @@
+package chat_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/yaocanwei/smallchat/chat"
+)
+
+// exampleClient is a line-based chat client for the examples.
+type exampleClient struct {
+	id   chat.ClientID
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// startServer serves a chat on a free loopback port. It returns the
+// server, its address and a function that shuts it down.
+func startServer() (*chat.ChatSystem, string, func()) {
+	config := chat.DefaultConfig()
+	config.AnnounceRecords = false
+	server, err := chat.New(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- server.Serve(ctx, l) }()
+	return server, l.Addr().String(), func() {
+		cancel()
+		if err := <-done; err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// connect connects a client and waits until it has joined, reading its ID
+// from its join notice.
+func connect(addr string) *exampleClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c := &exampleClient{conn: conn, r: bufio.NewReader(conn)}
+	for {
+		line := c.readLine()
+		if _, err := fmt.Sscanf(line, "* user:%d joined the chat", &c.id); err == nil {
+			return c
+		}
+	}
+}
+
+// readLine reads one line from the server.
+func (c *exampleClient) readLine() string {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		log.Fatal(err)
+	}
+	return strings.TrimSuffix(line, "\n")
+}
+
+// messages waits until the server has handled everything the client sent
+// and returns the lines received in the meantime, leaving out notices
+// about other clients.
+func (c *exampleClient) messages() []string {
+	fmt.Fprintf(c.conn, "/ping %s\n", c.id)
+	lines := []string{}
+	for {
+		line := c.readLine()
+		if strings.HasPrefix(line, "pong "+c.id.String()+" ") {
+			return lines
+		}
+		if !strings.HasPrefix(line, "* ") && !strings.Contains(line, " is now known as ") {
+			lines = append(lines, line)
+		}
+	}
+}
+
+func ExampleChatSystem_BroadcastTo() {
+	server, addr, stop := startServer()
+	defer stop()
+	alice := connect(addr)
+	bob := connect(addr)
+
+	server.BroadcastTo([]chat.ClientID{alice.id}, "Your account was approved\n")
+
+	fmt.Println("alice:", alice.messages())
+	fmt.Println("bob:", bob.messages())
+	// Output:
+	// alice: [Your account was approved]
+	// bob: []
+}
+
+func ExampleChatSystem_BroadcastWhere() {
+	server, addr, stop := startServer()
+	defer stop()
+	alice := connect(addr)
+	fmt.Fprintln(alice.conn, "/nick alice")
+	alice.messages()
+	anonymous := connect(addr)
+
+	server.BroadcastWhere(func(info chat.ObserverInfo) bool {
+		return info.Nick == ""
+	}, "Please pick a nickname with /nick\n")
+
+	fmt.Println("alice:", alice.messages())
+	fmt.Println("anonymous:", anonymous.messages())
+	// Output:
+	// alice: []
+	// anonymous: [Please pick a nickname with /nick]
+}
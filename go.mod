@@ -0,0 +1,3 @@
+module github.com/yaocanwei/smallchat
+
+go 1.22
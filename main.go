@@ -11,6 +11,7 @@
  * - Broadcasting messages to all clients.
  * - Go-routine for each client handling.
  * - Graceful shutdown on receiving interrupt or terminate signals.
+ * - Operator login with connection slots reserved for operators.
  *
  * Copyright (c) 2023, cheney
  * All rights reserved.
@@ -42,226 +43,67 @@
 package main
 
 import (
-	"bufio"
-	"fmt"
-	"io"
+	"context"
+	"flag"
 	"log"
-	"net"
-	"os"
 	"os/signal"
 	"strings"
-	"sync"
 	"syscall"
-)
 
-// Constants
-const (
-	ServerPort     = "7712"                                                                  // Port on which the chat server listens
-	MaxClients     = 1000                                                                    // Maximum number of allowed clients
-	welcomeMessage = "Welcome to the chat server! Type '/nick NAME' to set your nickname.\n" // Welcome message for clients
-	unknownCmdMsg  = "Unsupported command\n"                                                 // Message for unsupported commands
+	"github.com/yaocanwei/smallchat/chat"
 )
 
-// ChatObserver interface defines methods that chat clients should implement.
-type ChatObserver interface {
-	Notify(message string, senderID int)
-}
-
-// ChatSystem represents the chat server.
-type ChatSystem struct {
-	observers  []ChatObserver // List of chat observers (clients)
-	mu         sync.Mutex     // Mutex to protect concurrent access to the observers list
-	serversock net.Listener   // Listener for incoming client connections
-}
-
-// addObserver adds a chat observer (client) to the list.
-func (chat *ChatSystem) addObserver(observer ChatObserver) {
-	chat.mu.Lock()
-	defer chat.mu.Unlock()
-	chat.observers = append(chat.observers, observer)
-}
-
-// removeObserver removes a chat observer (client) from the list.
-func (chat *ChatSystem) removeObserver(observer ChatObserver) {
-	chat.mu.Lock()
-	defer chat.mu.Unlock()
-	for i, obs := range chat.observers {
-		if obs == observer {
-			chat.observers = append(chat.observers[:i], chat.observers[i+1:]...)
-			break
-		}
-	}
-}
-
-// broadcast sends a message to all connected chat clients.
-func (chat *ChatSystem) broadcast(message string, senderID int) {
-	chat.mu.Lock()
-	defer chat.mu.Unlock()
-	for _, observer := range chat.observers {
-		observer.Notify(message, senderID)
-	}
-}
-
-// Client represents a connected chat client.
-type Client struct {
-	id     int           // Unique client ID
-	nick   string        // Nickname of the client
-	conn   net.Conn      // Network connection
-	chat   *ChatSystem   // Reference to the chat system
-	reader *bufio.Reader // Buffered reader for reading client input
-}
-
-// Notify sends a message to the client.
-func (client *Client) Notify(message string, senderID int) {
-	// Send a message to the client
-	_, err := client.conn.Write([]byte(message))
-	if err != nil {
-		log.Printf("Error sending message to client %d: %v", client.id, err)
-	}
-}
-
-// listen listens for messages from the client and handles them.
-func (client *Client) listen() {
-	// Send the welcome message to the client
-	_, err := client.conn.Write([]byte(welcomeMessage))
+func main() {
+	config := chat.DefaultConfig()
+	flag.StringVar(&config.Port, "port", config.Port, "port to listen on")
+	flag.IntVar(&config.MaxClients, "max-clients", config.MaxClients, "maximum number of connected clients")
+	flag.IntVar(&config.ReservedSlots, "reserved-slots", config.ReservedSlots, "slots below max-clients reserved for operators")
+	flag.StringVar(&config.OperPassword, "oper-password", config.OperPassword, "password for the /oper command")
+	flag.DurationVar(&config.HandshakeTimeout, "handshake-timeout", config.HandshakeTimeout, "time a new connection has to send its first line before it is dropped, which also drops silent lurkers (0 to disable)")
+	flag.BoolVar(&config.Unfurl, "unfurl", config.Unfurl, "post the titles of links sent to the chat")
+	flag.IntVar(&config.MaxNickChanges, "max-nick-changes", config.MaxNickChanges, "nickname changes allowed per session (0 for unlimited)")
+	flag.StringVar(&config.IdentityPolicy, "identity-policy", config.IdentityPolicy, "identity required to post: anonymous-ok or nick-required")
+	flag.BoolVar(&config.UsageStats, "usage-stats", config.UsageStats, "count command and nickname usage for /stats")
+	flag.IntVar(&config.MaxFanOut, "max-fanout", config.MaxFanOut, "warn when one message reaches more recipients than this (0 to disable)")
+	flag.BoolVar(&config.WelcomeOccupants, "welcome-occupants", config.WelcomeOccupants, "list the clients already connected in the welcome")
+	flag.Float64Var(&config.MsgRate, "msg-rate", config.MsgRate, "lines a client may send per second (0 for unlimited)")
+	flag.IntVar(&config.ByteRate, "byte-rate", config.ByteRate, "bytes a client may send per second (0 for unlimited)")
+	flag.IntVar(&config.MaxHandlers, "max-handlers", config.MaxHandlers, "client handler goroutines allowed at once (0 for max-clients)")
+	flag.IntVar(&config.MaxSubscriptions, "max-subscriptions", config.MaxSubscriptions, "keywords a client may subscribe to (0 for unlimited)")
+	flag.DurationVar(&config.JoinCooldown, "join-cooldown", config.JoinCooldown, "time after connecting before a client's messages are posted (0 to disable)")
+	flag.StringVar(&config.CooldownPolicy, "cooldown-policy", config.CooldownPolicy, "what happens to messages during the join cooldown: reject or queue")
+	flag.StringVar(&config.LeaveScope, "leave-scope", config.LeaveScope, "who is told when a client disconnects: server or none")
+	flag.StringVar(&config.MaskSecrets, "mask-secrets", config.MaskSecrets, "comma-separated secret patterns to mask in messages, from aws, slack, pem, hex and base64; hex and base64 only after key=, token: or similar (empty to disable)")
+	flag.BoolVar(&config.AnnounceRecords, "announce-records", config.AnnounceRecords, "announce new peaks of connected clients, at most once an hour")
+	flag.StringVar(&config.PeakFile, "peak-file", config.PeakFile, "file to keep the peak of connected clients in across restarts (empty to keep it per run)")
+	flag.BoolVar(&config.LockStats, "lock-stats", config.LockStats, "measure contention on the chat lock and report it in /stats")
+	flag.IntVar(&config.MaxMentions, "max-mentions", config.MaxMentions, "distinct users a message may mention and still ring their bells (0 for unlimited)")
+	flag.IntVar(&config.RejectMentions, "reject-mentions", config.RejectMentions, "distinct users a message may mention before it is rejected (0 for unlimited)")
+	flag.IntVar(&config.WarnMute, "warn-mute", config.WarnMute, "warnings within -warn-window that mute a client (0 to disable)")
+	flag.IntVar(&config.WarnKick, "warn-kick", config.WarnKick, "warnings within -warn-window that kick a client (0 to disable)")
+	flag.DurationVar(&config.WarnWindow, "warn-window", config.WarnWindow, "how long a warning counts toward escalation")
+	flag.DurationVar(&config.MuteDuration, "mute-duration", config.MuteDuration, "how long an escalation mute lasts")
+	flag.IntVar(&config.MaxLength, "max-length", config.MaxLength, "longest message a client may post, in bytes (0 for unlimited)")
+	flag.StringVar(&config.QuietHours, "quiet-hours", config.QuietHours, "daily window such as 22:00-07:00 during which the quiet policy applies")
+	flag.StringVar(&config.QuietZone, "quiet-zone", config.QuietZone, "time zone of the quiet hours window")
+	flag.StringVar(&config.QuietPolicy, "quiet-policy", config.QuietPolicy, "policy during quiet hours: slow or readonly")
+	flag.DurationVar(&config.FlushInterval, "flush-interval", config.FlushInterval, "time to gather messages to a client into one write (0 to write at once)")
+	flag.IntVar(&config.MaxQueuedBytes, "max-queued-bytes", config.MaxQueuedBytes, "bytes queued for all clients together before the slowest are disconnected; join, leave and nick notices are shed from three quarters of it (0 for unlimited)")
+	flag.Func("quit-aliases", "comma-separated commands that disconnect the client (default \""+strings.Join(config.QuitAliases, ",")+"\")", func(s string) error {
+		config.QuitAliases = strings.Split(s, ",")
+		return nil
+	})
+	flag.Parse()
+
+	server, err := chat.New(config)
 	if err != nil {
-		log.Printf("Error sending message to client %d: %v", client.id, err)
+		log.Fatalf("Invalid configuration: %v", err)
 	}
 
-	for {
-		// Read a message from the client
-		msg, err := client.reader.ReadString('\n')
-		if err != nil {
-			if err != io.EOF {
-				log.Printf("Error reading from client %d: %v", client.id, err)
-			}
-			break
-		}
-
-		// Remove any potential carriage return characters
-		msg = strings.ReplaceAll(msg, "\r", "")
-
-		// Handle commands
-		client.handleCommand(msg)
-	}
-
-	// Remove the client from the chat
-	client.chat.removeObserver(client)
-	client.conn.Close()
-	fmt.Printf("Disconnected client clientID=%d\n", client.id)
-}
-
-// handleCommand handles commands sent by the client.
-func (client *Client) handleCommand(msg string) {
-	// Trim leading and trailing whitespace
-	msg = strings.TrimSpace(msg)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	// Check if the message is empty
-	if msg == "" {
-		// Ignore empty messages (e.g., when clients just hit enter)
-		return
-	}
-
-	// Check if the message is a command
-	if strings.HasPrefix(msg, "/") {
-		parts := strings.SplitN(msg, " ", 2)
-		command := strings.ToLower(parts[0])
-
-		switch command {
-		case "/nick":
-			client.handleNickCommand(parts)
-		default:
-			// Handle unknown commands
-			client.Notify(unknownCmdMsg, client.id)
-		}
-	} else {
-		// Regular message broadcasting
-		displayMsg := fmt.Sprintf("%s> %s\n", client.nick, msg)
-		if client.nick == "" {
-			displayMsg = fmt.Sprintf("user:%d> %s\n", client.id, msg)
-		}
-		client.chat.broadcast(displayMsg, client.id)
-	}
-}
-
-// handleNickCommand handles the /nick command to set a client's nickname.
-func (client *Client) handleNickCommand(parts []string) {
-	if len(parts) != 2 {
-		client.Notify("Usage: /nick <nickname>\n", client.id)
-		return
-	}
-
-	newNick := strings.TrimSpace(parts[1])
-	if newNick == "" {
-		client.Notify("Nickname cannot be empty\n", client.id)
-		return
-	}
-
-	client.nick = newNick
-	notifyMsg := fmt.Sprintf("User %d is now known as %s\n", client.id, client.nick)
-	log.Print(notifyMsg)
-	client.chat.broadcast(notifyMsg, client.id)
-}
-
-// main function
-func main() {
-	chat := &ChatSystem{}
-
-	err := chat.initChat(ServerPort)
-	if err != nil {
+	if err := server.Run(ctx); err != nil {
 		log.Fatalf("Error initializing chat: %v", err)
 	}
-	defer chat.serversock.Close()
-
-	exitSignal := make(chan os.Signal, 1)
-	signal.Notify(exitSignal, syscall.SIGINT, syscall.SIGTERM)
-
-	go func() {
-		for {
-			conn, err := chat.serversock.Accept()
-			if err != nil {
-				select {
-				case <-exitSignal:
-					return
-				default:
-					log.Printf("Error accepting connection: %v", err)
-					continue
-				}
-			}
-
-			clientID := chat.generateClientID()
-			client := &Client{
-				id:     clientID,
-				conn:   conn,
-				chat:   chat,
-				reader: bufio.NewReader(conn),
-			}
-
-			chat.addObserver(client)
-			if len(chat.observers) > MaxClients {
-				conn.Close() // Close the new connection if max clients exceeded
-				continue
-			}
-
-			fmt.Printf("Connected client clientid=%d\n", clientID)
-			go client.listen()
-		}
-	}()
-
-	<-exitSignal
-	fmt.Println("Server shutting down...")
-}
-
-// initChat initializes the chat server and listens on the specified port.
-func (chat *ChatSystem) initChat(port string) error {
-	var err error
-	chat.serversock, err = net.Listen("tcp", ":"+port)
-	return err
-}
-
-// generateClientID generates a unique client ID for a new client.
-func (chat *ChatSystem) generateClientID() int {
-	chat.mu.Lock()
-	defer chat.mu.Unlock()
-	return len(chat.observers) + 1
 }